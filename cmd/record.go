@@ -43,6 +43,10 @@ target server, and all requests and responses will be recorded.`,
 		if err != nil {
 			panic(err)
 		}
+		redactor, err = redactor.WithConfig(config.Redact)
+		if err != nil {
+			panic(err)
+		}
 
 		err = record.Record(config, recordingDir, redactor)
 		if err != nil {
@@ -47,6 +47,10 @@ recording is found.`,
 		if err != nil {
 			panic(err)
 		}
+		redactor, err = redactor.WithConfig(config.Redact)
+		if err != nil {
+			panic(err)
+		}
 
 		err = replay.Replay(config, replayRecordingDir, redactor)
 		if err != nil {
@@ -57,5 +61,5 @@ recording is found.`,
 
 func init() {
 	rootCmd.AddCommand(replayCmd)
-	replayCmd.Flags().StringVar(&replayRecordingDir, "recording-dir", "recordings", "Directory containing recorded requests and responses")
+	replayCmd.Flags().StringVar(&replayRecordingDir, "recording-dir", "recordings", "Directory or .zip, .tar, .tar.gz or .tgz archive containing recorded requests and responses")
 }
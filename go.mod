@@ -5,7 +5,9 @@ go 1.23.0
 toolchain go1.23.7
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.17.11
 	github.com/spf13/afero v1.14.0
 	github.com/spf13/cobra v1.9.1
 	github.com/stretchr/testify v1.10.0
@@ -18,6 +18,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v2"
@@ -31,7 +32,109 @@ type EndpointConfig struct {
 	SourceType                 string              `yaml:"source_type"`
 	Health                     string              `yaml:"health"`
 	RedactRequestHeaders       []string            `yaml:"redact_request_headers"`
+	RedactResponseHeaders      []string            `yaml:"redact_response_headers"`
+	AllowRequestHeaders        []string            `yaml:"allow_request_headers"`
+	AllowResponseHeaders       []string            `yaml:"allow_response_headers"`
+	RedactQueryParams          []string            `yaml:"redact_query_params"`
+	RemoveQueryParams          []string            `yaml:"remove_query_params"`
 	ResponseHeaderReplacements []HeaderReplacement `yaml:"response_header_replacements"`
+	Match                      *MatchConfig        `yaml:"match"`
+	IgnoreBodyFields           []string            `yaml:"ignore_body_fields"`
+	ReplayMode                 string              `yaml:"replay_mode"`
+	ReplayReusePolicy          string              `yaml:"replay_reuse_policy"`
+	ReplayLatency              *LatencyConfig      `yaml:"replay_latency"`
+	Redact                     *RedactConfig       `yaml:"redact"`
+}
+
+// RedactConfig lists patterns for secrets that are not known in advance. They
+// are redacted everywhere the literal TEST_SERVER_SECRETS are.
+type RedactConfig struct {
+	Patterns []RedactPattern `yaml:"patterns"`
+	Fields   []RedactField   `yaml:"fields"`
+	// Pseudonymize replaces each distinct secret with its own placeholder,
+	// such as REDACTED_4f2a9c0e1b3d5a7c, rather than with REDACTED. It is one
+	// of the Pseudonymize constants; pseudonymization is off when it is empty.
+	Pseudonymize string `yaml:"pseudonymize"`
+}
+
+// Pseudonymization modes.
+const (
+	// PseudonymizeHMAC derives the placeholder of a secret from its HMAC with
+	// the key in the TEST_SERVER_PSEUDONYM_KEY environment variable.
+	PseudonymizeHMAC = "hmac"
+)
+
+// RedactField redacts the values selected by Path in JSON request and response
+// bodies and websocket frames, without breaking the document.
+type RedactField struct {
+	// Path is a JSONPath selector such as $.user.email.
+	Path string `yaml:"path"`
+	// Action is one of the RedactAction constants. Defaults to replace.
+	Action string `yaml:"action"`
+	// Replace is the string that replaces the values. Defaults to REDACTED,
+	// or to the pseudonym of the value when pseudonymization is enabled.
+	Replace string `yaml:"replace"`
+}
+
+// Actions for redacted fields.
+const (
+	// RedactActionReplace replaces the value with a fixed string.
+	RedactActionReplace = "replace"
+	// RedactActionHash replaces the value with the SHA256 sum of its JSON
+	// encoding, so that different values stay different.
+	RedactActionHash = "hash"
+	// RedactActionDrop removes the value.
+	RedactActionDrop = "drop"
+)
+
+// RedactPattern replaces every match of Regex with Replace, a template that
+// may refer to submatches as $1 or ${name}. Without Replace the match, or only
+// its submatch named secret, is replaced with REDACTED or a pseudonym. A
+// pattern without a Regex enables the built-in pattern called Name.
+type RedactPattern struct {
+	Name    string `yaml:"name"`
+	Regex   string `yaml:"regex"`
+	Replace string `yaml:"replace"`
+}
+
+// LatencyConfig makes replay reproduce the recorded timing of responses.
+type LatencyConfig struct {
+	// Scale multiplies the recorded delays. Defaults to 1.
+	Scale float64 `yaml:"scale"`
+	// Max caps every single delay. Delays are not capped when it is zero.
+	Max time.Duration `yaml:"max"`
+}
+
+// Replay modes.
+const (
+	// ReplayModeChain matches a request together with the chain of requests
+	// that preceded it, so requests must be replayed in the recorded order.
+	ReplayModeChain = "chain"
+	// ReplayModeUnordered matches a request on its content alone.
+	ReplayModeUnordered = "unordered"
+)
+
+// Policies for serving identical interactions in unordered replay mode. Each
+// interaction is served once before moving to the next identical one; the
+// policy decides what happens after the last one has been served.
+const (
+	// ReusePolicyNext starts again from the first identical interaction.
+	ReusePolicyNext = "next"
+	// ReusePolicyRepeatLast keeps serving the last identical interaction.
+	ReusePolicyRepeatLast = "repeat_last"
+	// ReusePolicyFail fails the request.
+	ReusePolicyFail = "fail"
+)
+
+// MatchConfig selects the parts of a request that are used to match it
+// against a recording. When it is not set the whole serialized request is
+// used.
+type MatchConfig struct {
+	Method      bool     `yaml:"method"`
+	Path        bool     `yaml:"path"`
+	QueryParams []string `yaml:"query_params"`
+	Headers     []string `yaml:"headers"`
+	Body        bool     `yaml:"body"`
 }
 
 type HeaderReplacement struct {
@@ -42,6 +145,16 @@ type HeaderReplacement struct {
 
 type TestServerConfig struct {
 	Endpoints []EndpointConfig `yaml:"endpoints"`
+	// CompressRecordings makes record mode write gzip compressed
+	// <test>.json.gz recording files. Replay reads both forms.
+	CompressRecordings bool `yaml:"compress_recordings"`
+	// BlobThreshold is the size in bytes above which record mode stores a
+	// request or response body in a blobs/<sha256> file referenced from the
+	// recording. Zero, the default, keeps every body in the recording.
+	BlobThreshold int `yaml:"blob_threshold"`
+	// Redact holds the redaction patterns for all endpoints. Endpoints can
+	// add their own.
+	Redact *RedactConfig `yaml:"redact"`
 }
 
 func ReadConfig(filename string) (*TestServerConfig, error) {
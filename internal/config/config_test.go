@@ -18,6 +18,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -41,33 +42,133 @@ func TestReadConfigWithFs(t *testing.T) {
     target_type: https
     redact_request_headers:
       - X-Goog-Api-Key
+    redact_response_headers:
+      - Set-Cookie
+    allow_request_headers:
+      - Content-Type
+    allow_response_headers:
+      - Content-Type
+      - Set-Cookie
+    redact_query_params:
+      - key
+    remove_query_params:
+      - t
+    match:
+      method: true
+      path: true
+      query_params:
+        - alt
+      headers:
+        - Content-Type
+      body: true
   - target_host: api.example.com
     target_port: 8080
     source_port: 8081
     source_type: tcp
-    target_type: tcp`,
+    target_type: tcp
+    replay_mode: unordered
+    replay_reuse_policy: repeat_last
+    replay_latency:
+      scale: 0.5
+      max: 2s`,
 			filePath: "/test-config.yaml",
 			wantErr:  false,
 			wantConfig: &TestServerConfig{
 				Endpoints: []EndpointConfig{
 					{
-						TargetHost:           "www.google.com",
-						TargetPort:           443,
-						SourcePort:           1443,
-						SourceType:           "http",
-						TargetType:           "https",
-						RedactRequestHeaders: []string{"X-Goog-Api-Key"},
+						TargetHost:            "www.google.com",
+						TargetPort:            443,
+						SourcePort:            1443,
+						SourceType:            "http",
+						TargetType:            "https",
+						RedactRequestHeaders:  []string{"X-Goog-Api-Key"},
+						RedactResponseHeaders: []string{"Set-Cookie"},
+						AllowRequestHeaders:   []string{"Content-Type"},
+						AllowResponseHeaders:  []string{"Content-Type", "Set-Cookie"},
+						RedactQueryParams:     []string{"key"},
+						RemoveQueryParams:     []string{"t"},
+						Match: &MatchConfig{
+							Method:      true,
+							Path:        true,
+							QueryParams: []string{"alt"},
+							Headers:     []string{"Content-Type"},
+							Body:        true,
+						},
 					},
 					{
-						TargetHost: "api.example.com",
-						TargetPort: 8080,
-						SourcePort: 8081,
-						SourceType: "tcp",
-						TargetType: "tcp",
+						TargetHost:        "api.example.com",
+						TargetPort:        8080,
+						SourcePort:        8081,
+						SourceType:        "tcp",
+						TargetType:        "tcp",
+						ReplayMode:        ReplayModeUnordered,
+						ReplayReusePolicy: ReusePolicyRepeatLast,
+						ReplayLatency: &LatencyConfig{
+							Scale: 0.5,
+							Max:   2 * time.Second,
+						},
 					},
 				},
 			},
 		},
+		{
+			name: "recording storage",
+			fileContent: `compress_recordings: true
+blob_threshold: 65536
+endpoints:
+  - target_host: www.google.com
+    target_port: 443`,
+			filePath: "/compressed-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				Endpoints: []EndpointConfig{
+					{
+						TargetHost: "www.google.com",
+						TargetPort: 443,
+					},
+				},
+				CompressRecordings: true,
+				BlobThreshold:      65536,
+			},
+		},
+		{
+			name: "redact patterns",
+			fileContent: `redact:
+  patterns:
+    - name: google_api_key
+endpoints:
+  - target_host: www.google.com
+    target_port: 443
+    redact:
+      patterns:
+        - name: session
+          regex: (session=)[^;]+
+          replace: ${1}REDACTED
+      fields:
+        - path: $.user.email
+          action: hash`,
+			filePath: "/redact-config.yaml",
+			wantErr:  false,
+			wantConfig: &TestServerConfig{
+				Endpoints: []EndpointConfig{
+					{
+						TargetHost: "www.google.com",
+						TargetPort: 443,
+						Redact: &RedactConfig{
+							Patterns: []RedactPattern{
+								{Name: "session", Regex: "(session=)[^;]+", Replace: "${1}REDACTED"},
+							},
+							Fields: []RedactField{
+								{Path: "$.user.email", Action: RedactActionHash},
+							},
+						},
+					},
+				},
+				Redact: &RedactConfig{
+					Patterns: []RedactPattern{{Name: "google_api_key"}},
+				},
+			},
+		},
 		{
 			name:        "non-existent file",
 			fileContent: "",
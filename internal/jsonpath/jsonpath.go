@@ -0,0 +1,209 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jsonpath implements the subset of JSONPath used to select fields of
+// decoded JSON documents: `$`, `.name`, `['name']`, `[0]`, `[*]`, `.*` and the
+// recursive descent `..name`.
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Path is a parsed JSONPath expression.
+type Path struct {
+	expr  string
+	steps []step
+}
+
+type step struct {
+	// recursive applies the step at every depth below the current node.
+	recursive bool
+	wildcard  bool
+	isIndex   bool
+	name      string
+	index     int
+}
+
+// Parse parses a JSONPath expression such as `$.contents[*].parts[0].text`.
+func Parse(expr string) (*Path, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("jsonpath %q must start with '$'", expr)
+	}
+	p := &Path{expr: expr}
+	i := 1
+	for i < len(expr) {
+		recursive := false
+		switch {
+		case strings.HasPrefix(expr[i:], ".."):
+			recursive = true
+			i += 2
+		case expr[i] == '.':
+			i++
+		case expr[i] == '[':
+		default:
+			return nil, fmt.Errorf("jsonpath %q: unexpected %q at position %d", expr, expr[i], i)
+		}
+
+		var s step
+		var err error
+		if i < len(expr) && expr[i] == '[' {
+			s, i, err = parseBracket(expr, i)
+		} else {
+			s, i, err = parseName(expr, i)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.recursive = recursive
+		p.steps = append(p.steps, s)
+	}
+	return p, nil
+}
+
+func parseName(expr string, i int) (step, int, error) {
+	start := i
+	for i < len(expr) && expr[i] != '.' && expr[i] != '[' {
+		i++
+	}
+	name := expr[start:i]
+	if name == "" {
+		return step{}, i, fmt.Errorf("jsonpath %q: missing member name at position %d", expr, start)
+	}
+	if name == "*" {
+		return step{wildcard: true}, i, nil
+	}
+	return step{name: name}, i, nil
+}
+
+func parseBracket(expr string, i int) (step, int, error) {
+	end := strings.IndexByte(expr[i:], ']')
+	if end < 0 {
+		return step{}, i, fmt.Errorf("jsonpath %q: missing ']' for '[' at position %d", expr, i)
+	}
+	content := expr[i+1 : i+end]
+	next := i + end + 1
+	switch {
+	case content == "*":
+		return step{wildcard: true}, next, nil
+	case len(content) >= 2 && (content[0] == '\'' || content[0] == '"') && content[len(content)-1] == content[0]:
+		return step{name: content[1 : len(content)-1]}, next, nil
+	}
+	index, err := strconv.Atoi(content)
+	if err != nil {
+		return step{}, i, fmt.Errorf("jsonpath %q: invalid selector [%s]", expr, content)
+	}
+	return step{isIndex: true, index: index}, next, nil
+}
+
+// String returns the expression the path was parsed from.
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Update calls fn for every value of doc selected by the path. fn returns the
+// value to store in its place, or false to remove it. The input document is
+// not modified; containers along the updated paths are copied.
+func (p *Path) Update(doc any, fn func(value any) (any, bool)) any {
+	updated, keep := update(doc, p.steps, fn)
+	if !keep {
+		return nil
+	}
+	return updated
+}
+
+// Delete returns a copy of doc without the values selected by the path.
+func (p *Path) Delete(doc any) any {
+	return p.Update(doc, func(any) (any, bool) { return nil, false })
+}
+
+// Get returns the values of doc selected by the path.
+func (p *Path) Get(doc any) []any {
+	var values []any
+	p.Update(doc, func(value any) (any, bool) {
+		values = append(values, value)
+		return value, true
+	})
+	return values
+}
+
+func update(node any, steps []step, fn func(any) (any, bool)) (any, bool) {
+	if len(steps) == 0 {
+		return fn(node)
+	}
+	s := steps[0]
+	rest := steps[1:]
+
+	node = updateChildren(node, s, rest, fn)
+	if s.recursive {
+		// Descend into every child, keeping the recursive step in front.
+		node = updateChildren(node, step{wildcard: true}, steps, fn)
+	}
+	return node, true
+}
+
+// updateChildren applies rest to the children of node selected by s.
+func updateChildren(node any, s step, rest []step, fn func(any) (any, bool)) any {
+	switch n := node.(type) {
+	case map[string]any:
+		if s.isIndex {
+			return node
+		}
+		var out map[string]any
+		for key, child := range n {
+			if !s.wildcard && key != s.name {
+				continue
+			}
+			if out == nil {
+				out = make(map[string]any, len(n))
+				for k, v := range n {
+					out[k] = v
+				}
+			}
+			if updated, keep := update(child, rest, fn); keep {
+				out[key] = updated
+			} else {
+				delete(out, key)
+			}
+		}
+		if out == nil {
+			return node
+		}
+		return out
+	case []any:
+		if !s.wildcard && !s.isIndex {
+			return node
+		}
+		index := s.index
+		if index < 0 {
+			index += len(n)
+		}
+		out := make([]any, 0, len(n))
+		for i, child := range n {
+			if !s.wildcard && i != index {
+				out = append(out, child)
+				continue
+			}
+			if updated, keep := update(child, rest, fn); keep {
+				out = append(out, updated)
+			}
+		}
+		return out
+	}
+	return node
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const document = `{
+  "requestId": "abc",
+  "generationConfig": {"seed": 42, "temperature": 0.5},
+  "contents": [
+    {"role": "user", "parts": [{"text": "hi", "requestId": "def"}]},
+    {"role": "model", "parts": [{"text": "hello"}]}
+  ]
+}`
+
+func decode(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	require.NoError(t, json.Unmarshal([]byte(s), &v))
+	return v
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "Root", expr: "$"},
+		{name: "Dotted members", expr: "$.generationConfig.seed"},
+		{name: "Bracket members", expr: "$['generationConfig'][\"seed\"]"},
+		{name: "Wildcards and indexes", expr: "$.contents[*].parts[0].text"},
+		{name: "Recursive descent", expr: "$..requestId"},
+		{name: "Missing root", expr: "generationConfig.seed", wantErr: true},
+		{name: "Empty member", expr: "$.a..", wantErr: true},
+		{name: "Unterminated bracket", expr: "$.contents[0", wantErr: true},
+		{name: "Invalid index", expr: "$.contents[x]", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Parse(tc.expr)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expr, p.String())
+		})
+	}
+}
+
+func TestPath_Delete(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expr     string
+		expected string
+	}{
+		{
+			name:     "Nested member",
+			expr:     "$.generationConfig.seed",
+			expected: `{"requestId": "abc", "generationConfig": {"temperature": 0.5}, "contents": [{"role": "user", "parts": [{"text": "hi", "requestId": "def"}]}, {"role": "model", "parts": [{"text": "hello"}]}]}`,
+		},
+		{
+			name:     "Recursive descent",
+			expr:     "$..requestId",
+			expected: `{"generationConfig": {"seed": 42, "temperature": 0.5}, "contents": [{"role": "user", "parts": [{"text": "hi"}]}, {"role": "model", "parts": [{"text": "hello"}]}]}`,
+		},
+		{
+			name:     "Wildcard array elements",
+			expr:     "$.contents[*].role",
+			expected: `{"requestId": "abc", "generationConfig": {"seed": 42, "temperature": 0.5}, "contents": [{"parts": [{"text": "hi", "requestId": "def"}]}, {"parts": [{"text": "hello"}]}]}`,
+		},
+		{
+			name:     "Array index",
+			expr:     "$.contents[-1]",
+			expected: `{"requestId": "abc", "generationConfig": {"seed": 42, "temperature": 0.5}, "contents": [{"role": "user", "parts": [{"text": "hi", "requestId": "def"}]}]}`,
+		},
+		{
+			name:     "Missing member",
+			expr:     "$.missing.field",
+			expected: document,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Parse(tc.expr)
+			require.NoError(t, err)
+
+			doc := decode(t, document)
+			actual := p.Delete(doc)
+			require.Equal(t, decode(t, tc.expected), actual)
+			require.Equal(t, decode(t, document), doc, "input document was modified")
+		})
+	}
+}
+
+func TestPath_Update(t *testing.T) {
+	p, err := Parse("$.contents[*].parts[*].text")
+	require.NoError(t, err)
+
+	actual := p.Update(decode(t, document), func(value any) (any, bool) {
+		return value.(string) + "!", true
+	})
+	require.Equal(t, []any{"hi!", "hello!"}, p.Get(actual))
+}
+
+func TestPath_Get(t *testing.T) {
+	p, err := Parse("$..text")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []any{"hi", "hello"}, p.Get(decode(t, document)))
+}
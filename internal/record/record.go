@@ -19,10 +19,13 @@ package record
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/google/test-server/internal/config"
 	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/store"
 )
 
 func Record(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact) error {
@@ -32,17 +35,26 @@ func Record(cfg *config.TestServerConfig, recordingDir string, redactor *redact.
 	}
 
 	fmt.Printf("Recording to directory: %s\n", recordingDir)
+	storage := store.NewDirStorage(recordingDir)
+	storage.Compress = cfg.CompressRecordings
+	storage.BlobThreshold = cfg.BlobThreshold
+	session := NewSession(storage)
 	var wg sync.WaitGroup
 	errChan := make(chan error, len(cfg.Endpoints))
 
 	// Start a proxy for each endpoint
 	for _, endpoint := range cfg.Endpoints {
+		proxy, err := NewRecordingHTTPSProxy(&endpoint, session, redactor)
+		if err != nil {
+			return fmt.Errorf("invalid config for %s:%d: %w",
+				endpoint.TargetHost, endpoint.TargetPort, err)
+		}
+
 		wg.Add(1)
 		go func(ep config.EndpointConfig) {
 			defer wg.Done()
 
 			fmt.Printf("Starting server for %v\n", endpoint)
-			proxy := NewRecordingHTTPSProxy(&endpoint, recordingDir, redactor)
 			err := proxy.Start()
 
 			if err != nil {
@@ -58,11 +70,19 @@ func Record(cfg *config.TestServerConfig, recordingDir string, redactor *redact.
 		close(errChan)
 	}()
 
-	// Return the first error encountered, if any
-	for err := range errChan {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// Block until a proxy fails or test-server is stopped, then compact the
+	// journals into recording files.
+	select {
+	case err := <-errChan:
+		if flushErr := session.Flush(); flushErr != nil {
+			fmt.Printf("Error writing recordings: %v\n", flushErr)
+		}
 		return err
+	case sig := <-signals:
+		fmt.Printf("Received %v, compacting recordings\n", sig)
+		return session.Flush()
 	}
-
-	// Block forever (or until interrupted)
-	select {}
 }
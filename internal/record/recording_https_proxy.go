@@ -18,13 +18,12 @@ package record
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/google/test-server/internal/config"
 	"github.com/google/test-server/internal/redact"
@@ -32,26 +31,63 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// RecordingHTTPSProxy proxies requests to the target server of an endpoint
+// and records them. It handles concurrent requests.
 type RecordingHTTPSProxy struct {
-	prevRequestSHA string
-	seenFiles      map[string]store.RecordFile
-	config         *config.EndpointConfig
-	recordingDir   string
-	redactor       *redact.Redact
+	// mu guards chains.
+	mu sync.Mutex
+	// chains holds the sha256 sum of the last request to the endpoint recorded
+	// into each file, so that every test has its own chain of requests.
+	chains   map[string]string
+	session  *Session
+	config   *config.EndpointConfig
+	matcher  *store.Matcher
+	redactor *redact.Redact
+	client   *http.Client
 }
 
-func NewRecordingHTTPSProxy(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact) *RecordingHTTPSProxy {
-	return &RecordingHTTPSProxy{
-		prevRequestSHA: store.HeadSHA,
-		seenFiles:      make(map[string]store.RecordFile),
-		config:         cfg,
-		recordingDir:   recordingDir,
-		redactor:       redactor,
+// FlushPath is the path at which every endpoint compacts the journals of the
+// session into recording files, for clients that cannot stop test-server with
+// SIGINT or SIGTERM, such as on Windows.
+const FlushPath = "/test-server/flush"
+
+// NewRecordingHTTPSProxy creates a proxy for the endpoint recording into the
+// files of the session.
+func NewRecordingHTTPSProxy(cfg *config.EndpointConfig, session *Session, redactor *redact.Redact) (*RecordingHTTPSProxy, error) {
+	matcher, err := store.NewMatcher(cfg)
+	if err != nil {
+		return nil, err
 	}
+	redactor, err = redactor.WithConfig(cfg.Redact)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingHTTPSProxy{
+		chains:   make(map[string]string),
+		session:  session,
+		config:   cfg,
+		matcher:  matcher,
+		redactor: redactor,
+		client:   http.DefaultClient,
+	}, nil
 }
 
+// ResetChain starts a new chain of requests for every recording file.
 func (r *RecordingHTTPSProxy) ResetChain() {
-	r.prevRequestSHA = store.HeadSHA
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chains = make(map[string]string)
+}
+
+// chainHead returns the sha256 sum of the last request recorded into the
+// file, or HeadSHA when no request was recorded into it yet.
+func (r *RecordingHTTPSProxy) chainHead(fileName string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if shaSum, ok := r.chains[fileName]; ok {
+		return shaSum
+	}
+	return store.HeadSHA
 }
 
 func (r *RecordingHTTPSProxy) Start() error {
@@ -71,24 +107,30 @@ func (r *RecordingHTTPSProxy) handleRequest(w http.ResponseWriter, req *http.Req
 		w.WriteHeader(http.StatusOK)
 		return
 	}
+	if req.URL.Path == FlushPath {
+		if err := r.session.Flush(); err != nil {
+			fmt.Printf("Error writing recordings: %v\n", err)
+			http.Error(w, fmt.Sprintf("Error writing recordings: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	fmt.Printf("Recording request: %s %s\n", req.Method, req.URL.String())
 
-	recReq, err := r.redactRequest(req)
+	recReq, err := r.redactRequest(req, store.HeadSHA)
 	if err != nil {
 		fmt.Printf("Error recording request: %v\n", err)
 		http.Error(w, fmt.Sprintf("Error recording request: %v", err), http.StatusInternalServerError)
 		return
 	}
-	fileName, err := recReq.GetRecordingFileName()
+	fileName, err := r.matcher.RecordingFileName(recReq)
 	if err != nil {
 		fmt.Printf("Invalid recording file name: %v\n", err)
 		http.Error(w, fmt.Sprintf("Invalid recording file name: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if _, ok := r.seenFiles[fileName]; !ok {
-		// Reset to HeadSHA when first time seen a request from the given file.
-		recReq.PreviousRequest = store.HeadSHA
-	}
+	recReq.PreviousRequest = r.chainHead(fileName)
 
 	if req.Header.Get("Upgrade") == "websocket" {
 		fmt.Printf("Upgrading connection to websocket...\n")
@@ -96,45 +138,53 @@ func (r *RecordingHTTPSProxy) handleRequest(w http.ResponseWriter, req *http.Req
 		return
 	}
 
-	resp, respBody, err := r.proxyRequest(w, req)
+	resp, respBody, timing, err := r.proxyRequest(w, req)
 	if err != nil {
 		fmt.Printf("Error proxying request: %v\n", err)
 		http.Error(w, fmt.Sprintf("Error proxying request: %v", err), http.StatusInternalServerError)
 		return
 	}
-	shaSum := recReq.ComputeSum()
-	err = r.recordResponse(recReq, resp, fileName, shaSum, respBody)
+	shaSum := r.matcher.Sum(recReq)
+	err = r.recordResponse(recReq, resp, fileName, shaSum, respBody, timing)
 	if err != nil {
 		fmt.Printf("Error recording response: %v\n", err)
 		http.Error(w, fmt.Sprintf("Error recording response: %v", err), http.StatusInternalServerError)
 		return
 	}
 	if fileName != shaSum {
-		r.prevRequestSHA = shaSum
+		r.mu.Lock()
+		r.chains[fileName] = shaSum
+		r.mu.Unlock()
 	}
 }
 
-func (r *RecordingHTTPSProxy) redactRequest(req *http.Request) (*store.RecordedRequest, error) {
-	recordedRequest, err := store.NewRecordedRequest(req, r.prevRequestSHA, *r.config)
+func (r *RecordingHTTPSProxy) redactRequest(req *http.Request, prevRequestSHA string) (*store.RecordedRequest, error) {
+	recordedRequest, err := store.NewRecordedRequest(req, prevRequestSHA, *r.config)
 	if err != nil {
 		return recordedRequest, err
 	}
 
 	// Redact headers by key
 	recordedRequest.RedactHeaders(r.config.RedactRequestHeaders)
+	recordedRequest.AllowHeaders(r.config.AllowRequestHeaders)
+	recordedRequest.RedactQueryParams(r.config.RedactQueryParams, r.config.RemoveQueryParams, r.redactor)
 	// Redacts secrets from header values
 	r.redactor.Headers(recordedRequest.Headers)
 	recordedRequest.Request = r.redactor.String(recordedRequest.Request)
 	recordedRequest.URL = r.redactor.String(recordedRequest.URL)
-	var redactedBodySegments []map[string]any
+	var redactedBodySegments []any
 	for _, bodySegment := range recordedRequest.BodySegments {
-		redactedBodySegments = append(redactedBodySegments, r.redactor.Map(bodySegment))
+		redactedBodySegments = append(redactedBodySegments, r.redactor.Value(bodySegment))
 	}
 	recordedRequest.BodySegments = redactedBodySegments
+	recordedRequest.Body = recordedRequest.Body.Redact(r.redactor)
 	return recordedRequest, nil
 }
 
-func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Request) (*http.Response, []byte, error) {
+// proxyRequest forwards the request to the target server and streams the
+// response back to the client. It returns the response, its body and when the
+// parts of the response were received.
+func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Request) (*http.Response, []byte, *store.Timing, error) {
 	url := fmt.Sprintf("https://%s:%d%s", r.config.TargetHost, r.config.TargetPort, req.URL.Path)
 	if req.URL.RawQuery != "" {
 		url += "?" + req.URL.RawQuery
@@ -142,13 +192,13 @@ func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Requ
 
 	bodyBytes, err := io.ReadAll(req.Body)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	req.Body.Close()
 
 	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(bodyBytes))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	for name, values := range req.Header {
@@ -157,10 +207,13 @@ func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Requ
 		}
 	}
 
-	resp, err := http.DefaultClient.Do(proxyReq)
+	start := time.Now()
+	resp, err := r.client.Do(proxyReq)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+	defer resp.Body.Close()
+	firstByte := time.Since(start)
 
 	r.applyResponseHeaderReplacements(resp.Header)
 
@@ -172,61 +225,62 @@ func (r *RecordingHTTPSProxy) proxyRequest(w http.ResponseWriter, req *http.Requ
 
 	w.WriteHeader(resp.StatusCode)
 
-	respBodyBytes, err := io.ReadAll(resp.Body)
+	// Send original (compressed) body to client as it arrives.
+	respBodyBytes, chunks, err := streamBody(w, resp.Body, start)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+	timing := store.NewTiming(resp.Header, respBodyBytes, firstByte, chunks)
+	return resp, respBodyBytes, timing, nil
+}
 
-	w.Write(respBodyBytes) // Send original (compressed) body to client
-	return resp, respBodyBytes, nil
+// streamBody copies body to the client chunk by chunk, flushing after every
+// chunk so streamed responses reach the client incrementally. It returns all
+// the bytes read from body and when each chunk was received, relative to
+// start. When the client goes away the rest of the body is still read so that
+// the recording is complete.
+func streamBody(w http.ResponseWriter, body io.Reader, start time.Time) ([]byte, []store.ChunkTiming, error) {
+	flusher, _ := w.(http.Flusher)
+	var recorded bytes.Buffer
+	var chunks []store.ChunkTiming
+	var writeErr error
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			recorded.Write(buf[:n])
+			chunks = append(chunks, store.ChunkTiming{End: recorded.Len(), Elapsed: time.Since(start)})
+			if writeErr == nil {
+				if _, writeErr = w.Write(buf[:n]); writeErr != nil {
+					fmt.Printf("Error writing response to client: %v\n", writeErr)
+				} else if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+		if err == io.EOF {
+			return recorded.Bytes(), chunks, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 }
 
-func (r *RecordingHTTPSProxy) recordResponse(recReq *store.RecordedRequest, resp *http.Response, fileName string, shaSum string, body []byte) error {
-	recordedResponse, err := store.NewRecordedResponse(resp, r.redactor, body)
+func (r *RecordingHTTPSProxy) recordResponse(recReq *store.RecordedRequest, resp *http.Response, fileName string, shaSum string, body []byte, timing *store.Timing) error {
+	recordedResponse, err := store.NewRecordedResponse(resp, *r.config, r.redactor, body)
 	if err != nil {
 		return err
 	}
-
-	recordFile, ok := r.seenFiles[fileName]
-	if !ok {
-		r.seenFiles[fileName] = store.RecordFile{RecordID: fileName, Interactions: []*store.RecordInteraction{}}
-		recordFile = r.seenFiles[fileName]
-	}
+	recordedResponse.Timing = timing
 
 	var recordInteraction store.RecordInteraction
 	recordInteraction.Request = recReq
 	recordInteraction.SHASum = shaSum
 	recordInteraction.Response = recordedResponse
+	recordInteraction.Endpoint = store.EndpointName(r.config)
 
-	recordFile.Interactions = append(recordFile.Interactions, &recordInteraction)
-	r.seenFiles[fileName] = recordFile
-
-	recordPath := filepath.Join(r.recordingDir, fileName+".json")
-
-	recordDir := filepath.Dir(recordPath)
-	if err := os.MkdirAll(recordDir, 0755); err != nil {
-		return err
-	}
-
-	// Default to overwriting the file.
-	fileMode := os.O_TRUNC
-	file, err := os.OpenFile(recordPath, fileMode|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	interaction, err := json.MarshalIndent(recordFile, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	_, err = file.WriteString(string(interaction))
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return r.session.Record(fileName, &recordInteraction)
 }
 
 // applyResponseHeaderReplacements applies the header replacements defined in the EndpointConfig to the request headers.
@@ -263,8 +317,7 @@ func (r *RecordingHTTPSProxy) proxyWebsocket(w http.ResponseWriter, req *http.Re
 	go r.pumpWebsocket(clientConn, conn, c, quit, ">")
 	go r.pumpWebsocket(conn, clientConn, c, quit, "<")
 
-	recordPath := filepath.Join(r.recordingDir, fileName+".websocket.log")
-	f, err := os.Create(recordPath)
+	f, err := r.session.storage.CreateWebsocketLog(fileName, store.EndpointName(r.config))
 	if err != nil {
 		fmt.Printf("Error creating websocket recording file: %v\n", err)
 		http.Error(w, fmt.Sprintf("Error proxying websocket: %v", err), http.StatusInternalServerError)
@@ -301,8 +354,8 @@ func (r *RecordingHTTPSProxy) pumpWebsocket(src, dst *websocket.Conn, c chan []b
 			quit <- 1
 			return
 		}
+		redactedBuf := append(r.redactor.JSON(buf), '\n')
 		buf = append(buf, '\n')
-		redactedBuf := r.redactor.Bytes(buf)
 		prefix := fmt.Sprintf("%s%d ", prepend, len(redactedBuf))
 		c <- append([]byte(prefix), redactedBuf...)
 		err = dst.WriteMessage(msgType, buf)
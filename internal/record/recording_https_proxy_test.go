@@ -0,0 +1,508 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/replay"
+	"github.com/google/test-server/internal/store"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkedReader returns one chunk per Read call and records how much of the
+// stream the client had received before each read.
+type chunkedReader struct {
+	chunks   []string
+	recorder *httptest.ResponseRecorder
+	received []string
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	c.received = append(c.received, c.recorder.Body.String())
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return n, nil
+}
+
+func TestStreamBody(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	reader := &chunkedReader{
+		chunks:   []string{"data: 1\n\n", "data: 2\n\n", "data: 3\n\n"},
+		recorder: recorder,
+	}
+
+	body, chunks, err := streamBody(recorder, reader, time.Now())
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	require.Equal(t, 27, chunks[2].End)
+	require.Equal(t, "data: 1\n\ndata: 2\n\ndata: 3\n\n", string(body))
+	require.Equal(t, string(body), recorder.Body.String())
+	require.True(t, recorder.Flushed)
+
+	// Every chunk reached the client before the next one was read.
+	require.Equal(t, []string{"", "data: 1\n\n", "data: 1\n\ndata: 2\n\n", "data: 1\n\ndata: 2\n\ndata: 3\n\n"}, reader.received)
+}
+
+// newTestProxy creates a RecordingHTTPSProxy for the upstream server and
+// returns a server that serves the proxy.
+func newTestProxy(t *testing.T, upstream *httptest.Server, cfg config.EndpointConfig) (*RecordingHTTPSProxy, *httptest.Server) {
+	t.Helper()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+	require.NoError(t, err)
+
+	cfg.TargetHost = upstreamURL.Hostname()
+	cfg.TargetPort = port
+	cfg.TargetType = "https"
+	proxy, err := NewRecordingHTTPSProxy(&cfg, NewSession(store.NewFsStorage(afero.NewMemMapFs())), nil)
+	require.NoError(t, err)
+	proxy.client = upstream.Client()
+
+	server := httptest.NewServer(http.HandlerFunc(proxy.handleRequest))
+	t.Cleanup(server.Close)
+	return proxy, server
+}
+
+// echoHandler answers with a JSON object holding the request body.
+func echoHandler(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"echo": %q}`, body)
+}
+
+// readRecordFile compacts the recordings of the session and reads one of them.
+func readRecordFile(t *testing.T, session *Session, name string) *store.RecordFile {
+	t.Helper()
+	require.NoError(t, session.Flush())
+	recordFile, err := session.storage.LoadRecordFile(name)
+	require.NoError(t, err)
+	return recordFile
+}
+
+func TestRecordingHTTPSProxy_ConcurrentRequests(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	proxy, server := newTestProxy(t, upstream, config.EndpointConfig{})
+
+	const tests = 8
+	const requestsPerTest = 10
+	var wg sync.WaitGroup
+	for i := 0; i < tests; i++ {
+		for j := 0; j < requestsPerTest; j++ {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				body := fmt.Sprintf(`{"test": %d, "request": %d}`, i, j)
+				req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(body))
+				if !assert.NoError(t, err) {
+					return
+				}
+				req.Header.Set("Test-Name", fmt.Sprintf("test-%d", i))
+				resp, err := http.DefaultClient.Do(req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer resp.Body.Close()
+				respBody, err := io.ReadAll(resp.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, fmt.Sprintf(`{"echo": %q}`, body), string(respBody))
+			}(i, j)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < tests; i++ {
+		recordFile := readRecordFile(t, proxy.session, fmt.Sprintf("test-%d", i))
+		require.Len(t, recordFile.Interactions, requestsPerTest)
+		for _, interaction := range recordFile.Interactions {
+			require.Equal(t, float64(i), interaction.Request.BodySegments[0].(map[string]any)["test"])
+			requestBody, err := json.Marshal(interaction.Request.BodySegments[0])
+			require.NoError(t, err)
+			var response map[string]string
+			require.NoError(t, json.Unmarshal([]byte(interaction.Response.Body.Data), &response))
+			require.JSONEq(t, string(requestBody), response["echo"])
+		}
+	}
+}
+
+func TestRecordingHTTPSProxy_PerTestChains(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	proxy, server := newTestProxy(t, upstream, config.EndpointConfig{})
+
+	// Interleave the requests of two tests.
+	for j := 0; j < 3; j++ {
+		for _, testName := range []string{"test-a", "test-b"} {
+			req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(fmt.Sprintf(`{"request": %d}`, j)))
+			require.NoError(t, err)
+			req.Header.Set("Test-Name", testName)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	for _, testName := range []string{"test-a", "test-b"} {
+		recordFile := readRecordFile(t, proxy.session, testName)
+		require.Len(t, recordFile.Interactions, 3)
+		previousRequest := store.HeadSHA
+		for _, interaction := range recordFile.Interactions {
+			require.Equal(t, previousRequest, interaction.Request.PreviousRequest)
+			previousRequest = interaction.SHASum
+		}
+	}
+}
+
+func TestRecordingHTTPSProxy_RedactPatterns(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	proxy, server := newTestProxy(t, upstream, config.EndpointConfig{
+		Redact: &config.RedactConfig{
+			Patterns: []config.RedactPattern{
+				{Name: "bearer_token"},
+				{Name: "oauth_access_token"},
+			},
+		},
+	})
+
+	req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(`{"token": "ya29.secret"}`))
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	req.Header.Set("Authorization", "Bearer ya29.secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	// Only the recording is redacted, the client gets the real response.
+	require.Contains(t, string(body), "ya29.secret")
+
+	recordFile := readRecordFile(t, proxy.session, "test")
+	require.Len(t, recordFile.Interactions, 1)
+	interaction := recordFile.Interactions[0]
+	require.Equal(t, "Bearer REDACTED", interaction.Request.Headers["Authorization"])
+	require.Equal(t, []any{map[string]any{"token": "REDACTED"}}, interaction.Request.BodySegments)
+	require.NotContains(t, interaction.Response.Body.Data, "ya29.secret")
+}
+
+func TestRecordingHTTPSProxy_RedactFields(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, req.Body)
+	}))
+	defer upstream.Close()
+	proxy, server := newTestProxy(t, upstream, config.EndpointConfig{
+		Redact: &config.RedactConfig{
+			Fields: []config.RedactField{
+				{Path: "$.user.email"},
+				{Path: "$.user.phone", Action: config.RedactActionDrop},
+			},
+		},
+	})
+
+	requestBody := `{"user": {"email": "a@example.com", "phone": "555", "name": "a"}}`
+	req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(requestBody))
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, requestBody, string(body))
+
+	recordFile := readRecordFile(t, proxy.session, "test")
+	require.Len(t, recordFile.Interactions, 1)
+	interaction := recordFile.Interactions[0]
+	expected := map[string]any{"user": map[string]any{"email": "REDACTED", "name": "a"}}
+	require.Equal(t, []any{expected}, interaction.Request.BodySegments)
+	require.JSONEq(t, `{"user": {"email": "REDACTED", "name": "a"}}`, interaction.Response.Body.Data)
+}
+
+func TestRecordingHTTPSProxy_SharedSession(t *testing.T) {
+	session := NewSession(store.NewFsStorage(afero.NewMemMapFs()))
+	var servers []*httptest.Server
+	var endpoints []string
+	for i := 0; i < 2; i++ {
+		upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+		defer upstream.Close()
+		upstreamURL, err := url.Parse(upstream.URL)
+		require.NoError(t, err)
+		port, err := strconv.ParseInt(upstreamURL.Port(), 10, 64)
+		require.NoError(t, err)
+
+		cfg := &config.EndpointConfig{TargetHost: upstreamURL.Hostname(), TargetPort: port, TargetType: "https"}
+		proxy, err := NewRecordingHTTPSProxy(cfg, session, nil)
+		require.NoError(t, err)
+		proxy.client = upstream.Client()
+		server := httptest.NewServer(http.HandlerFunc(proxy.handleRequest))
+		defer server.Close()
+		servers = append(servers, server)
+		endpoints = append(endpoints, store.EndpointName(cfg))
+	}
+
+	for j := 0; j < 2; j++ {
+		for _, server := range servers {
+			req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(fmt.Sprintf(`{"request": %d}`, j)))
+			require.NoError(t, err)
+			req.Header.Set("Test-Name", "test")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	recordFile := readRecordFile(t, session, "test")
+	require.Len(t, recordFile.Interactions, 4)
+	for i, interaction := range recordFile.Interactions {
+		require.Equal(t, endpoints[i%2], interaction.Endpoint)
+	}
+}
+
+func TestRecordingHTTPSProxy_MultipartRoundTrip(t *testing.T) {
+	var uploads int
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uploads++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"upload": %d}`, uploads)
+	}))
+	defer upstream.Close()
+	proxy, recordServer := newTestProxy(t, upstream, config.EndpointConfig{})
+
+	// upload sends a multipart upload, with a new random boundary every time.
+	upload := func(server *httptest.Server, i int) (int, string) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		require.NoError(t, writer.WriteField("name", fmt.Sprintf("file-%d", i)))
+		part, err := writer.CreateFormFile("file", "file.txt")
+		require.NoError(t, err)
+		_, err = part.Write([]byte("content"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req, err := http.NewRequest("POST", server.URL+"/v1/upload", &body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Test-Name", "test")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(respBody)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, _ := upload(recordServer, i)
+		require.Equal(t, http.StatusOK, status)
+	}
+	recordFile := readRecordFile(t, proxy.session, "test")
+	require.Len(t, recordFile.Interactions, 2)
+	request := recordFile.Interactions[0].Request
+	require.Equal(t, "multipart/form-data; boundary="+store.MultipartBoundary, request.Headers["Content-Type"])
+	require.Equal(t, "multipart/form-data; boundary="+store.MultipartBoundary, request.Body.ContentType)
+	require.Contains(t, request.Body.Data, "--"+store.MultipartBoundary+"\r\n")
+
+	replayServer, err := replay.NewReplayHTTPServer(proxy.config, proxy.session.storage, nil)
+	require.NoError(t, err)
+	server := httptest.NewServer(replayServer)
+	defer server.Close()
+	for i := 0; i < 2; i++ {
+		status, body := upload(server, i)
+		require.Equal(t, http.StatusOK, status, body)
+		require.JSONEq(t, fmt.Sprintf(`{"upload": %d}`, i+1), body)
+	}
+}
+
+func TestSession_Record(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := store.NewFsStorage(fs)
+	// The recording of an earlier run is replaced.
+	require.NoError(t, storage.SaveRecordFile("test", &store.RecordFile{
+		RecordID:     "test",
+		Interactions: []*store.RecordInteraction{{SHASum: "old"}},
+	}))
+	session := NewSession(storage)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, session.Record("test", &store.RecordInteraction{SHASum: strconv.Itoa(i)}))
+		// Every interaction is stored before Record returns, so nothing is
+		// lost when test-server is killed.
+		recordFile, err := storage.LoadRecordFile("test")
+		require.NoError(t, err)
+		require.Len(t, recordFile.Interactions, i+1)
+		require.Equal(t, strconv.Itoa(i), recordFile.Interactions[i].SHASum)
+	}
+	_, err := fs.Stat("/test.json")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSession_Flush(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	session := NewSession(store.NewFsStorage(fs))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, session.Record("test", &store.RecordInteraction{SHASum: strconv.Itoa(i)}))
+	}
+	require.NoError(t, session.Flush())
+	// The journal is replaced with the recording file.
+	_, err := fs.Stat("/test.jsonl")
+	require.True(t, os.IsNotExist(err))
+	recordFile, err := session.storage.LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Len(t, recordFile.Interactions, 3)
+
+	// Interactions recorded after a flush are appended to the recording.
+	require.NoError(t, session.Record("test", &store.RecordInteraction{SHASum: "3"}))
+	require.Len(t, readRecordFile(t, session, "test").Interactions, 4)
+
+	// No temporary file is left behind.
+	entries, err := afero.ReadDir(fs, "/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestSession_NewTestCompactsEndedTests(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := store.NewFsStorage(fs)
+	storage.Compress = true
+	session := NewSession(storage)
+
+	require.NoError(t, session.Record("test-a", &store.RecordInteraction{SHASum: "a0"}))
+	require.NoError(t, session.Record("test-a", &store.RecordInteraction{SHASum: "a1"}))
+	_, err := fs.Stat("/test-a.jsonl")
+	require.NoError(t, err)
+
+	// The first request of the next test ends the previous one.
+	require.NoError(t, session.Record("test-b", &store.RecordInteraction{SHASum: "b0"}))
+	entries, err := afero.ReadDir(fs, "/")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, []string{"test-a.json.gz", "test-b.jsonl"}, names)
+	recordFile, err := storage.LoadRecordFile("test-a")
+	require.NoError(t, err)
+	require.Len(t, recordFile.Interactions, 2)
+}
+
+// TestSession_Killed records two tests in a child process and kills it, which
+// a process cannot handle, as on Windows.
+func TestSession_Killed(t *testing.T) {
+	if dir := os.Getenv("TEST_SERVER_KILLED_DIR"); dir != "" {
+		storage := store.NewDirStorage(dir)
+		storage.Compress = true
+		session := NewSession(storage)
+		for _, name := range []string{"test-a", "test-b"} {
+			for i := 0; i < 2; i++ {
+				require.NoError(t, session.Record(name, &store.RecordInteraction{SHASum: fmt.Sprintf("%s-%d", name, i)}))
+			}
+		}
+		fmt.Println("recorded")
+		time.Sleep(time.Minute)
+		return
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSession_Killed$")
+	cmd.Env = append(os.Environ(), "TEST_SERVER_KILLED_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && scanner.Text() != "recorded" {
+	}
+	require.NoError(t, cmd.Process.Kill())
+	require.Error(t, cmd.Wait())
+
+	// The ended test was compacted, the last one is left in its journal.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, []string{"test-a.json.gz", "test-b.jsonl"}, names)
+	storage := store.NewDirStorage(dir)
+	for _, name := range []string{"test-a", "test-b"} {
+		recordFile, err := storage.LoadRecordFile(name)
+		require.NoError(t, err)
+		require.Len(t, recordFile.Interactions, 2)
+	}
+}
+
+func TestRecordingHTTPSProxy_Flush(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	proxy, server := newTestProxy(t, upstream, config.EndpointConfig{})
+
+	req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(`{"request": 0}`))
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+FlushPath, "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// The journal was compacted into the recording file.
+	info, err := proxy.session.storage.StatRecordFile("test")
+	require.NoError(t, err)
+	require.Equal(t, "test.json", info.Name())
+	recordFile, err := proxy.session.storage.LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Len(t, recordFile.Interactions, 1)
+}
+
+func TestSession_RecordError(t *testing.T) {
+	session := NewSession(store.NewFsStorage(afero.NewReadOnlyFs(afero.NewMemMapFs())))
+
+	// The request that could not be recorded gets the error.
+	require.Error(t, session.Record("test", &store.RecordInteraction{SHASum: "0"}))
+	require.Error(t, session.Record("test", &store.RecordInteraction{SHASum: "1"}))
+	require.NoError(t, session.Flush())
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/test-server/internal/store"
+)
+
+// Session holds the recording files written by every endpoint of a
+// test-server process. A test that calls several endpoints gets a single
+// recording file holding the interactions of all of them.
+//
+// Every interaction is appended to the journal of its recording file before
+// Record returns, so it survives the process being killed. The journals of a
+// test are compacted into its recording file when the next test starts, and
+// every journal is compacted by Flush, at shutdown or when a client asks for
+// it at FlushPath.
+type Session struct {
+	storage store.Storage
+	// mu guards files.
+	mu    sync.Mutex
+	files map[string]*recordingFile
+}
+
+// recordingFile holds the interactions recorded into a file. Its lock guards
+// the other fields and serializes the writes to the file.
+type recordingFile struct {
+	mu         sync.Mutex
+	name       string
+	recordFile store.RecordFile
+	// journaled is set while interactions are appended to the journal of the
+	// file rather than saved in the file itself.
+	journaled bool
+}
+
+// NewSession creates a Session saving its recording files to storage.
+func NewSession(storage store.Storage) *Session {
+	return &Session{
+		storage: storage,
+		files:   make(map[string]*recordingFile),
+	}
+}
+
+// Record appends the interaction to the journal of the recording file, which
+// replaces the file recorded by an earlier test-server process. The first
+// interaction of a test compacts the journals of the other tests.
+func (s *Session) Record(fileName string, interaction *store.RecordInteraction) error {
+	s.mu.Lock()
+	file, ok := s.files[fileName]
+	var ended []*recordingFile
+	if !ok {
+		// A new test started, so the tests recorded before it are over,
+		// unless they run in parallel and record into their file again.
+		for _, other := range s.files {
+			ended = append(ended, other)
+		}
+		file = &recordingFile{
+			name:       fileName,
+			recordFile: store.RecordFile{RecordID: fileName, Interactions: []*store.RecordInteraction{}},
+		}
+		s.files[fileName] = file
+	}
+	s.mu.Unlock()
+
+	for _, other := range ended {
+		// The interactions are safe in the journal, so the error does not
+		// concern this request.
+		if err := s.flush(other); err != nil {
+			fmt.Printf("Error compacting recording file %s: %v\n", other.name, err)
+		}
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if !file.journaled {
+		if err := s.storage.StartJournal(file.name, file.recordFile.Interactions); err != nil {
+			return err
+		}
+		file.journaled = true
+	}
+	if err := s.storage.AppendInteraction(file.name, interaction); err != nil {
+		return err
+	}
+	file.recordFile.Interactions = append(file.recordFile.Interactions, interaction)
+	return nil
+}
+
+// Flush replaces the journal of every recording file with the file itself.
+func (s *Session) Flush() error {
+	s.mu.Lock()
+	files := make([]*recordingFile, 0, len(s.files))
+	for _, file := range s.files {
+		files = append(files, file)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, file := range files {
+		if err := s.flush(file); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %w", file.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flush saves the file if interactions were appended to its journal.
+func (s *Session) flush(file *recordingFile) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if !file.journaled {
+		return nil
+	}
+	if err := s.storage.SaveRecordFile(file.name, &file.recordFile); err != nil {
+		return err
+	}
+	file.journaled = false
+	return nil
+}
@@ -17,17 +17,75 @@ limitations under the License.
 package redact
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"os"
 	"regexp"
 	"strings"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
 )
 
 // REDACTED is the string used to replace redacted secrets.
 const REDACTED = "REDACTED"
 
-// Redact holds the compiled regex for redacting secrets.
+// PseudonymKeyEnv is the environment variable holding the key of the hmac
+// pseudonymization mode.
+const PseudonymKeyEnv = "TEST_SERVER_PSEUDONYM_KEY"
+
+// Redact holds the compiled rules for redacting secrets.
 type Redact struct {
-	regex *regexp.Regexp
+	rules      []rule
+	fields     []field
+	pseudonyms *pseudonyms
+}
+
+// rule replaces every match of regex with the replace template. When the
+// template is empty, the match, or its submatch named secret, is replaced with
+// a placeholder.
+type rule struct {
+	regex   *regexp.Regexp
+	replace string
+}
+
+// field replaces, hashes or drops the values of a JSON document selected by
+// path.
+type field struct {
+	path    *jsonpath.Path
+	action  string
+	replace string
+}
+
+// pseudonyms derives the placeholder of each distinct secret from an HMAC of
+// the secret, so that it does not depend on the order in which secrets are
+// seen, in record mode as in replay mode.
+type pseudonyms struct {
+	key []byte
+}
+
+// name returns the placeholder of a secret.
+func (p *pseudonyms) name(secret string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(secret))
+	return REDACTED + "_" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// builtinPatterns are the patterns that can be enabled by name alone.
+var builtinPatterns = map[string]config.RedactPattern{
+	"bearer_token": {
+		Regex: `(?i)bearer\s+(?P<secret>[0-9A-Za-z._~+/=-]+)`,
+	},
+	"google_api_key": {
+		Regex: `AIza[0-9A-Za-z_-]{35}`,
+	},
+	"oauth_access_token": {
+		Regex: `ya29\.[0-9A-Za-z_-]+`,
+	},
 }
 
 // NewRedact creates a new Redact instance with the given secrets.
@@ -40,7 +98,7 @@ func NewRedact(secrets []string) (*Redact, error) {
 	}
 
 	if len(filteredSecrets) == 0 {
-		return &Redact{regex: nil}, nil // No secrets to redact
+		return &Redact{}, nil // No secrets to redact
 	}
 
 	regexPattern := strings.Join(filteredSecrets, "|")
@@ -49,55 +107,256 @@ func NewRedact(secrets []string) (*Redact, error) {
 		return nil, err
 	}
 
-	return &Redact{regex: re}, nil
+	return &Redact{rules: []rule{{regex: re}}}, nil
+}
+
+// WithConfig returns a Redact that also redacts the fields and patterns of
+// cfg, after those of r. Fields are redacted before secrets and patterns.
+//
+// A pattern without a regex refers to one of the built-in patterns by name.
+// Matches are replaced with the pattern's replacement template, which may
+// refer to submatches as in regexp.Regexp.Expand. Without a template the
+// match, or only its submatch named secret when there is one, is replaced with
+// REDACTED, or with a pseudonym when cfg enables pseudonymization.
+func (r *Redact) WithConfig(cfg *config.RedactConfig) (*Redact, error) {
+	if cfg == nil || (len(cfg.Patterns) == 0 && len(cfg.Fields) == 0 && cfg.Pseudonymize == "") {
+		return r, nil
+	}
+	redacted := &Redact{}
+	if r != nil {
+		redacted.rules = append(redacted.rules, r.rules...)
+		redacted.fields = append(redacted.fields, r.fields...)
+		redacted.pseudonyms = r.pseudonyms
+	}
+	switch cfg.Pseudonymize {
+	case "":
+	case config.PseudonymizeHMAC:
+		key := os.Getenv(PseudonymKeyEnv)
+		if key == "" {
+			return nil, fmt.Errorf("pseudonymize %q needs a key in %s", cfg.Pseudonymize, PseudonymKeyEnv)
+		}
+		redacted.pseudonyms = &pseudonyms{key: []byte(key)}
+	default:
+		return nil, fmt.Errorf("unknown pseudonymize mode %q", cfg.Pseudonymize)
+	}
+	for _, f := range cfg.Fields {
+		path, err := jsonpath.Parse(f.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact field: %w", err)
+		}
+		switch f.Action {
+		case "", config.RedactActionReplace, config.RedactActionHash, config.RedactActionDrop:
+		default:
+			return nil, fmt.Errorf("unknown action %q for redact field %s", f.Action, f.Path)
+		}
+		redacted.fields = append(redacted.fields, field{path: path, action: f.Action, replace: f.Replace})
+	}
+	for _, pattern := range cfg.Patterns {
+		if pattern.Regex == "" {
+			builtin, ok := builtinPatterns[pattern.Name]
+			if !ok {
+				return nil, fmt.Errorf("redact pattern %q has no regex and is not a built-in pattern", pattern.Name)
+			}
+			pattern.Regex = builtin.Regex
+		}
+		re, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for redact pattern %q: %w", pattern.Name, err)
+		}
+		redacted.rules = append(redacted.rules, rule{regex: re, replace: pattern.Replace})
+	}
+	return redacted, nil
+}
+
+// empty reports whether r has nothing to redact.
+func (r *Redact) empty() bool {
+	return r == nil || (len(r.rules) == 0 && len(r.fields) == 0)
+}
+
+// Placeholder returns the string that replaces a secret found by other means
+// than the rules of r, REDACTED or the secret's pseudonym.
+func (r *Redact) Placeholder(secret string) string {
+	if r == nil {
+		return REDACTED
+	}
+	return r.placeholder(secret)
+}
+
+// placeholder returns the string that replaces a secret.
+func (r *Redact) placeholder(secret string) string {
+	if r.pseudonyms == nil {
+		return REDACTED
+	}
+	return r.pseudonyms.name(secret)
+}
+
+// redactField returns the value that replaces a value selected by the field,
+// or false to drop it.
+func (r *Redact) redactField(f field, value any) (any, bool) {
+	switch f.action {
+	case config.RedactActionDrop:
+		return nil, false
+	case config.RedactActionHash:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return REDACTED, true
+		}
+		hash := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(hash[:]), true
+	default:
+		if f.replace != "" {
+			return f.replace, true
+		}
+		// Strings share their placeholder with the same secret found
+		// anywhere else.
+		secret, ok := value.(string)
+		if !ok {
+			data, _ := json.Marshal(value)
+			secret = string(data)
+		}
+		return r.placeholder(secret), true
+	}
+}
+
+// replace redacts the matches of the rule in the input string.
+func (r *Redact) replace(rule rule, input string) string {
+	if rule.replace != "" {
+		return rule.regex.ReplaceAllString(input, rule.replace)
+	}
+	group := rule.regex.SubexpIndex("secret")
+	matches := rule.regex.FindAllStringSubmatchIndex(input, -1)
+	if matches == nil {
+		return input
+	}
+	var out strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if group > 0 {
+			start, end = match[2*group], match[2*group+1]
+			if start < 0 {
+				continue
+			}
+		}
+		out.WriteString(input[last:start])
+		out.WriteString(r.placeholder(input[start:end]))
+		last = end
+	}
+	out.WriteString(input[last:])
+	return out.String()
 }
 
 // Headers redacts the secrets in the values of the http.Header.
 func (r *Redact) Headers(headers map[string]string) {
-	if r == nil || r.regex == nil {
+	if r == nil || len(r.rules) == 0 {
 		return // No redactor or no secrets configured
 	}
 	for name, value := range headers {
-		headers[name] = r.regex.ReplaceAllString(value, REDACTED)
+		headers[name] = r.String(value)
 	}
 }
 
 // String redacts the secrets in the input string.
 func (r *Redact) String(input string) string {
-	if r == nil || r.regex == nil {
+	if r == nil || len(r.rules) == 0 {
 		return input // No redactor or no secrets configured
 	}
-	return r.regex.ReplaceAllString(input, REDACTED)
+	for _, rule := range r.rules {
+		input = r.replace(rule, input)
+	}
+	return input
 }
 
 // Bytes redacts the secrets in the input byte slice.
 func (r *Redact) Bytes(input []byte) []byte {
-	if r == nil || r.regex == nil {
+	if r == nil || len(r.rules) == 0 {
 		return input // No redactor or no secrets configured
 	}
 	if input == nil {
 		return nil // Return nil if input is nil
 	}
-	return r.regex.ReplaceAll(input, []byte(REDACTED))
+	return append([]byte(nil), r.String(string(input))...)
 }
 
-func (r *Redact) Map(input map[string]any) map[string]any {
-	if r == nil || r.regex == nil {
+// Value redacts the fields and the secrets of a decoded JSON value. The
+// secrets are redacted in every string and object key of the value, so the
+// result is always a valid document. The input value is not modified.
+func (r *Redact) Value(input any) any {
+	if r.empty() {
 		return input // No redactor or no secrets configured
 	}
 	if input == nil {
-		return nil // Return nil if input is nil
-	}
-	jsonBytes, err := json.Marshal(input)
-	if err != nil {
 		return nil
 	}
-	redactedJsonBytes := r.Bytes(jsonBytes)
-	var redactedMap map[string]any
-	err = json.Unmarshal(redactedJsonBytes, &redactedMap)
-	if err != nil {
-		return nil
+	for _, field := range r.fields {
+		input = field.path.Update(input, func(value any) (any, bool) {
+			return r.redactField(field, value)
+		})
 	}
+	return r.strings(input)
+}
 
-	return redactedMap
+// strings redacts the secrets in the strings and object keys of a decoded
+// JSON value.
+func (r *Redact) strings(input any) any {
+	switch v := input.(type) {
+	case string:
+		return r.String(v)
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		for key, value := range v {
+			redacted[r.String(key)] = r.strings(value)
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(v))
+		for i, value := range v {
+			redacted[i] = r.strings(value)
+		}
+		return redacted
+	default:
+		return input
+	}
+}
+
+// Map redacts the fields and the secrets of a decoded JSON object.
+func (r *Redact) Map(input map[string]any) map[string]any {
+	if input == nil {
+		return nil // Return nil if input is nil
+	}
+	redacted, _ := r.Value(input).(map[string]any)
+	return redacted
+}
+
+// JSON redacts the fields and the secrets of an encoded JSON document, such
+// as a response body or a websocket frame. The document is only re-encoded
+// when one of the fields is present in it, and then loses its formatting.
+// Input that is not a JSON document only has its secrets redacted.
+func (r *Redact) JSON(input []byte) []byte {
+	if r == nil || len(r.fields) == 0 {
+		return r.Bytes(input)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return r.Bytes(input)
+	}
+	changed := false
+	for _, field := range r.fields {
+		doc = field.path.Update(doc, func(value any) (any, bool) {
+			changed = true
+			return r.redactField(field, value)
+		})
+	}
+	if !changed {
+		return r.Bytes(input)
+	}
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return r.Bytes(input)
+	}
+	return r.Bytes(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
 }
@@ -17,8 +17,11 @@ limitations under the License.
 package redact
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/google/test-server/internal/config"
 	"github.com/stretchr/testify/require"
 )
 
@@ -265,3 +268,256 @@ func TestRedact_Map(t *testing.T) {
 		})
 	}
 }
+
+func TestRedact_WithConfig(t *testing.T) {
+	apiKey := "AIza" + "0123456789abcdefghijABCDEFGHIJ_-xyz"
+	testCases := []struct {
+		name           string
+		input          string
+		secrets        []string
+		patterns       []config.RedactPattern
+		expectedOutput string
+		expectedErr    bool
+	}{
+		{
+			name:           "Custom pattern",
+			input:          "session=s3cr3t; path=/",
+			patterns:       []config.RedactPattern{{Name: "session", Regex: `session=[^;]+`}},
+			expectedOutput: "REDACTED; path=/",
+		},
+		{
+			name:  "Replacement template",
+			input: "session=s3cr3t; path=/",
+			patterns: []config.RedactPattern{
+				{Name: "session", Regex: `(session=)[^;]+`, Replace: "${1}<session>"},
+			},
+			expectedOutput: "session=<session>; path=/",
+		},
+		{
+			name:           "Built-in bearer token",
+			input:          "Authorization: Bearer abc.DEF-123_~+/=",
+			patterns:       []config.RedactPattern{{Name: "bearer_token"}},
+			expectedOutput: "Authorization: Bearer REDACTED",
+		},
+		{
+			name:           "Built-in Google API key",
+			input:          "/v1/models?key=" + apiKey,
+			patterns:       []config.RedactPattern{{Name: "google_api_key"}},
+			expectedOutput: "/v1/models?key=REDACTED",
+		},
+		{
+			name:           "Built-in OAuth access token",
+			input:          `{"access_token": "ya29.a0AfH6SM-abc_123"}`,
+			patterns:       []config.RedactPattern{{Name: "oauth_access_token", Replace: "<token>"}},
+			expectedOutput: `{"access_token": "<token>"}`,
+		},
+		{
+			name:           "Secrets and patterns",
+			input:          "abc ya29.token",
+			secrets:        []string{"abc"},
+			patterns:       []config.RedactPattern{{Name: "oauth_access_token"}},
+			expectedOutput: "REDACTED REDACTED",
+		},
+		{
+			name:        "Unknown built-in pattern",
+			patterns:    []config.RedactPattern{{Name: "unknown"}},
+			expectedErr: true,
+		},
+		{
+			name:        "Invalid regex",
+			patterns:    []config.RedactPattern{{Name: "invalid", Regex: "("}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redactor, err := NewRedact(tc.secrets)
+			require.NoError(t, err)
+			redactor, err = redactor.WithConfig(&config.RedactConfig{Patterns: tc.patterns})
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, redactor.String(tc.input))
+			require.Equal(t, []byte(tc.expectedOutput), redactor.Bytes([]byte(tc.input)))
+		})
+	}
+}
+
+func TestRedact_Fields(t *testing.T) {
+	testCases := []struct {
+		name           string
+		input          string
+		secrets        []string
+		fields         []config.RedactField
+		expectedOutput string
+	}{
+		{
+			name:           "Replace field",
+			input:          `{"user": {"email": "a@example.com", "name": "a"}}`,
+			fields:         []config.RedactField{{Path: "$.user.email"}},
+			expectedOutput: `{"user":{"email":"REDACTED","name":"a"}}`,
+		},
+		{
+			name:  "Replace with custom string",
+			input: `{"contents": [{"parts": [{"inlineData": {"data": "aGVsbG8="}}, {"text": "hi"}]}]}`,
+			fields: []config.RedactField{
+				{Path: "$.contents[*].parts[*].inlineData.data", Action: config.RedactActionReplace, Replace: "<data>"},
+			},
+			expectedOutput: `{"contents":[{"parts":[{"inlineData":{"data":"<data>"}},{"text":"hi"}]}]}`,
+		},
+		{
+			name:           "Hash field",
+			input:          `{"user": {"email": "a@example.com"}}`,
+			fields:         []config.RedactField{{Path: "$.user.email", Action: config.RedactActionHash}},
+			expectedOutput: `{"user":{"email":"sha256:8595b682a16ba7dd9ce222fc3313a721afef9340a2ad2fa87315b2b2b435f5ed"}}`,
+		},
+		{
+			name:           "Drop field",
+			input:          `{"user": {"email": "a@example.com", "name": "a"}}`,
+			fields:         []config.RedactField{{Path: "$..email", Action: config.RedactActionDrop}},
+			expectedOutput: `{"user":{"name":"a"}}`,
+		},
+		{
+			name:           "Fields and secrets",
+			input:          `{"token": "abc", "email": "a@example.com", "n": 1.50}`,
+			secrets:        []string{"abc"},
+			fields:         []config.RedactField{{Path: "$.email"}},
+			expectedOutput: `{"email":"REDACTED","n":1.50,"token":"REDACTED"}`,
+		},
+		{
+			name:           "Missing field keeps the document",
+			input:          "{\"user\": \"abc\"}\n",
+			secrets:        []string{"abc"},
+			fields:         []config.RedactField{{Path: "$.email"}},
+			expectedOutput: "{\"user\": \"REDACTED\"}\n",
+		},
+		{
+			name:           "Not a JSON document",
+			input:          "email=a@example.com&token=abc",
+			secrets:        []string{"abc"},
+			fields:         []config.RedactField{{Path: "$.email"}},
+			expectedOutput: "email=a@example.com&token=REDACTED",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			redactor, err := NewRedact(tc.secrets)
+			require.NoError(t, err)
+			redactor, err = redactor.WithConfig(&config.RedactConfig{Fields: tc.fields})
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, string(redactor.JSON([]byte(tc.input))))
+		})
+	}
+
+	t.Run("Decoded value", func(t *testing.T) {
+		redactor, err := NewRedact([]string{"abc"})
+		require.NoError(t, err)
+		redactor, err = redactor.WithConfig(&config.RedactConfig{
+			Fields: []config.RedactField{{Path: "$[*].email", Action: config.RedactActionDrop}},
+		})
+		require.NoError(t, err)
+		input := []any{map[string]any{"email": "a@example.com", "token": "abc", "n": float64(123)}}
+		expected := []any{map[string]any{"token": "REDACTED", "n": float64(123)}}
+		require.Equal(t, expected, redactor.Value(input))
+		// The input is not modified.
+		require.Equal(t, "a@example.com", input[0].(map[string]any)["email"])
+	})
+
+	t.Run("Invalid config", func(t *testing.T) {
+		_, err := (&Redact{}).WithConfig(&config.RedactConfig{Fields: []config.RedactField{{Path: "user"}}})
+		require.Error(t, err)
+		_, err = (&Redact{}).WithConfig(&config.RedactConfig{Fields: []config.RedactField{{Path: "$.user", Action: "encrypt"}}})
+		require.Error(t, err)
+	})
+}
+
+func TestRedact_Pseudonymize(t *testing.T) {
+	newRedactor := func(t *testing.T) *Redact {
+		t.Helper()
+		redactor, err := NewRedact([]string{"tok1", "tok2"})
+		require.NoError(t, err)
+		redactor, err = redactor.WithConfig(&config.RedactConfig{
+			Patterns:     []config.RedactPattern{{Name: "google_api_key"}, {Name: "bearer_token"}},
+			Fields:       []config.RedactField{{Path: "$.user"}},
+			Pseudonymize: config.PseudonymizeHMAC,
+		})
+		require.NoError(t, err)
+		return redactor
+	}
+
+	t.Run("Map with several secrets", func(t *testing.T) {
+		t.Setenv(PseudonymKeyEnv, "key")
+		keys := []string{
+			"AIza" + strings.Repeat("a", 35),
+			"AIza" + strings.Repeat("b", 35),
+			"AIza" + strings.Repeat("c", 35),
+		}
+		var expected map[string]string
+		for i := 0; i < 200; i++ {
+			headers := map[string]string{"X-Key-A": keys[0], "X-Key-B": keys[1], "X-Key-C": keys[2]}
+			newRedactor(t).Headers(headers)
+			if expected == nil {
+				expected = headers
+				continue
+			}
+			require.Equal(t, expected, headers)
+		}
+		require.Len(t, map[string]bool{expected["X-Key-A"]: true, expected["X-Key-B"]: true, expected["X-Key-C"]: true}, 3)
+
+		value := newRedactor(t).Value(map[string]any{"a": keys[0], "b": []any{keys[1], keys[2]}})
+		require.Equal(t, map[string]any{"a": expected["X-Key-A"], "b": []any{expected["X-Key-B"], expected["X-Key-C"]}}, value)
+	})
+
+	t.Run("Secrets seen in responses", func(t *testing.T) {
+		t.Setenv(PseudonymKeyEnv, "key")
+		request := "Bearer tok2"
+		// Record mode also redacts responses, replay mode only requests.
+		recording := newRedactor(t)
+		recording.JSON([]byte(`{"user": "bob", "token": "tok1"}`))
+		require.Equal(t, newRedactor(t).String(request), recording.String(request))
+	})
+
+	t.Run("Fields and strings share placeholders", func(t *testing.T) {
+		t.Setenv(PseudonymKeyEnv, "key")
+		redactor := newRedactor(t)
+		redacted := string(redactor.JSON([]byte(`{"user": "tok1", "token": "tok1"}`)))
+		placeholder := redactor.String("tok1")
+		require.Equal(t, fmt.Sprintf(`{"token":%q,"user":%q}`, placeholder, placeholder), redacted)
+	})
+
+	t.Run("HMAC", func(t *testing.T) {
+		t.Setenv(PseudonymKeyEnv, "key")
+		cfg := &config.RedactConfig{Pseudonymize: config.PseudonymizeHMAC}
+		redactor, err := NewRedact([]string{"tok1", "tok2"})
+		require.NoError(t, err)
+		redactor, err = redactor.WithConfig(cfg)
+		require.NoError(t, err)
+		other, err := NewRedact([]string{"tok2", "tok1"})
+		require.NoError(t, err)
+		other, err = other.WithConfig(cfg)
+		require.NoError(t, err)
+
+		// The placeholders do not depend on the order the secrets are seen.
+		tok1 := redactor.String("tok1")
+		tok2 := redactor.String("tok2")
+		require.Regexp(t, `^REDACTED_[0-9a-f]{16}$`, tok1)
+		require.NotEqual(t, tok1, tok2)
+		require.Equal(t, tok2, other.String("tok2"))
+		require.Equal(t, tok1, other.String("tok1"))
+	})
+
+	t.Run("HMAC without key", func(t *testing.T) {
+		t.Setenv(PseudonymKeyEnv, "")
+		_, err := (&Redact{}).WithConfig(&config.RedactConfig{Pseudonymize: config.PseudonymizeHMAC})
+		require.Error(t, err)
+	})
+
+	t.Run("Unknown mode", func(t *testing.T) {
+		_, err := (&Redact{}).WithConfig(&config.RedactConfig{Pseudonymize: "random"})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/test-server/internal/store"
+)
+
+// racyWindow is how long after a recording file was modified its
+// modification time and size may stay the same across writes. File systems
+// store modification times with a granularity of up to two seconds.
+const racyWindow = 2 * time.Second
+
+// recordingIndex holds the interactions of a recording file recorded for an
+// endpoint, indexed for lookup.
+type recordingIndex struct {
+	// modTime and size identify the version of the file the index was built
+	// from.
+	modTime time.Time
+	size    int64
+	// loadedAt is when the file was loaded.
+	loadedAt     time.Time
+	interactions []*store.RecordInteraction
+	// bySHA maps a sha256 sum to the first interaction recorded with it.
+	bySHA map[string]*store.RecordInteraction
+	// byContent maps the content sum of a request to the interactions
+	// recorded with it, in recorded order.
+	byContent map[string][]*store.RecordInteraction
+}
+
+// loadIndex returns the index of the recording file. The index is cached and
+// rebuilt when the file changes in storage.
+//
+// A file rewritten with the same size within the granularity of modification
+// times cannot be told apart from the cached version, so the index of a file
+// loaded less than racyWindow after it was modified is never reused.
+func (r *ReplayHTTPServer) loadIndex(fileName string) (*recordingIndex, error) {
+	info, err := r.storage.StatRecordFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %s.json: %w", fileName, err)
+	}
+
+	r.indexMu.Lock()
+	index, ok := r.indexes[fileName]
+	r.indexMu.Unlock()
+	if ok && index.modTime.Equal(info.ModTime()) && index.size == info.Size() && index.loadedAt.Sub(index.modTime) > racyWindow {
+		return index, nil
+	}
+
+	loadedAt := time.Now()
+	recordFile, err := r.storage.LoadRecordFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not load file %s.json: %w", fileName, err)
+	}
+
+	index = &recordingIndex{
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		loadedAt: loadedAt,
+		// A recording file holds the interactions of every endpoint the test called.
+		interactions: r.endpointInteractions(recordFile.Interactions),
+		bySHA:        make(map[string]*store.RecordInteraction),
+		byContent:    make(map[string][]*store.RecordInteraction),
+	}
+	for _, interaction := range index.interactions {
+		if _, ok := index.bySHA[interaction.SHASum]; !ok {
+			index.bySHA[interaction.SHASum] = interaction
+		}
+		if interaction.Request != nil {
+			contentSum := r.matcher.ContentSum(interaction.Request)
+			index.byContent[contentSum] = append(index.byContent[contentSum], interaction)
+		}
+	}
+
+	r.indexMu.Lock()
+	r.indexes[fileName] = index
+	r.indexMu.Unlock()
+	return index, nil
+}
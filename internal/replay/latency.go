@@ -0,0 +1,103 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/store"
+)
+
+// pacer delays the parts of a replayed response to reproduce the timing that
+// was recorded for them. It does nothing when latency simulation is disabled
+// or the response has no recorded timing.
+type pacer struct {
+	ctx    context.Context
+	cfg    *config.LatencyConfig
+	timing *store.Timing
+	// elapsed is the recorded offset of the last part that was written.
+	elapsed time.Duration
+	// sleep waits for the delay or until ctx is done.
+	sleep func(ctx context.Context, delay time.Duration) error
+}
+
+func newPacer(ctx context.Context, cfg *config.LatencyConfig, timing *store.Timing) *pacer {
+	return &pacer{ctx: ctx, cfg: cfg, timing: timing, sleep: sleep}
+}
+
+// waitFirstByte waits until the response headers are due.
+func (p *pacer) waitFirstByte() error {
+	if p.timing == nil {
+		return nil
+	}
+	return p.wait(p.timing.FirstByteMs)
+}
+
+// waitSegment waits until the i-th streamed segment is due.
+func (p *pacer) waitSegment(i int) error {
+	if p.timing == nil || i >= len(p.timing.SegmentOffsetsMs) {
+		return nil
+	}
+	return p.wait(p.timing.SegmentOffsetsMs[i])
+}
+
+// waitBody waits until the whole body is due.
+func (p *pacer) waitBody() error {
+	if p.timing == nil || len(p.timing.SegmentOffsetsMs) == 0 {
+		return nil
+	}
+	return p.wait(p.timing.SegmentOffsetsMs[len(p.timing.SegmentOffsetsMs)-1])
+}
+
+// wait sleeps for the time between the previous part and the part recorded
+// at offsetMs, scaled and capped as configured. It returns early with an
+// error when the client goes away.
+func (p *pacer) wait(offsetMs int64) error {
+	if p.cfg == nil {
+		return nil
+	}
+	offset := time.Duration(offsetMs) * time.Millisecond
+	delay := offset - p.elapsed
+	if delay <= 0 {
+		return nil
+	}
+	p.elapsed = offset
+
+	if p.cfg.Scale > 0 {
+		delay = time.Duration(float64(delay) * p.cfg.Scale)
+	}
+	if p.cfg.Max > 0 && delay > p.cfg.Max {
+		delay = p.cfg.Max
+	}
+
+	return p.sleep(p.ctx, delay)
+}
+
+// sleep waits for the delay. It returns early with the error of ctx when ctx
+// is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacer(t *testing.T) {
+	timing := &store.Timing{FirstByteMs: 40, SegmentOffsetsMs: []int64{60, 200}}
+	ms := time.Millisecond
+
+	testCases := []struct {
+		name     string
+		cfg      *config.LatencyConfig
+		expected []time.Duration
+	}{
+		{name: "Disabled", cfg: nil, expected: nil},
+		{name: "Recorded timing", cfg: &config.LatencyConfig{}, expected: []time.Duration{40 * ms, 20 * ms, 140 * ms}},
+		{name: "Scaled", cfg: &config.LatencyConfig{Scale: 0.5}, expected: []time.Duration{20 * ms, 10 * ms, 70 * ms}},
+		{name: "Capped", cfg: &config.LatencyConfig{Max: 10 * ms}, expected: []time.Duration{10 * ms, 10 * ms, 10 * ms}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPacer(context.Background(), tc.cfg, timing)
+			var delays []time.Duration
+			p.sleep = func(ctx context.Context, delay time.Duration) error {
+				delays = append(delays, delay)
+				return nil
+			}
+			require.NoError(t, p.waitFirstByte())
+			require.NoError(t, p.waitSegment(0))
+			require.NoError(t, p.waitSegment(1))
+			// The body is due with its last segment.
+			require.NoError(t, p.waitBody())
+			require.Equal(t, tc.expected, delays)
+		})
+	}
+}
+
+func TestPacer_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := newPacer(ctx, &config.LatencyConfig{}, &store.Timing{FirstByteMs: 1000})
+	require.ErrorIs(t, p.waitFirstByte(), context.Canceled)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/test-server/internal/store"
+)
+
+// MismatchError is returned when no recorded interaction matches a request.
+// It describes how the request differs from the closest recorded interactions.
+type MismatchError struct {
+	File   string `json:"file"`
+	ShaSum string `json:"shaSum"`
+	// ExpectedNext is the interaction recorded after the request's previous request.
+	ExpectedNext *InteractionDiff `json:"expectedNext,omitempty"`
+	// Nearest is the interaction with the fewest differing fields.
+	Nearest *InteractionDiff `json:"nearest,omitempty"`
+}
+
+// InteractionDiff holds the differences between a request and a recorded interaction.
+type InteractionDiff struct {
+	Index  int               `json:"index"`
+	ShaSum string            `json:"shaSum"`
+	Diffs  []store.FieldDiff `json:"diffs"`
+}
+
+// newMismatchError compares the parts of the request selected by the matcher
+// with every recorded interaction. When ignoreChain is set the position of
+// the requests in the chain is not compared.
+func newMismatchError(matcher *store.Matcher, file string, shaSum string, req *store.RecordedRequest, interactions []*store.RecordInteraction, ignoreChain bool) *MismatchError {
+	mismatch := &MismatchError{File: file, ShaSum: shaSum}
+	for i, interaction := range interactions {
+		if interaction.Request == nil {
+			continue
+		}
+		recorded := interaction.Request
+		if ignoreChain {
+			unchained := *recorded
+			unchained.PreviousRequest = req.PreviousRequest
+			recorded = &unchained
+		}
+		diff := &InteractionDiff{
+			Index:  i,
+			ShaSum: interaction.SHASum,
+			Diffs:  matcher.DiffRequests(recorded, req),
+		}
+		if mismatch.Nearest == nil || len(diff.Diffs) < len(mismatch.Nearest.Diffs) {
+			mismatch.Nearest = diff
+		}
+		if !ignoreChain && mismatch.ExpectedNext == nil && interaction.Request.PreviousRequest == req.PreviousRequest {
+			mismatch.ExpectedNext = diff
+		}
+	}
+	return mismatch
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("response with shaSum %s not found in file %s", e.ShaSum, e.File)
+}
+
+// Report returns the mismatch as indented JSON.
+func (e *MismatchError) Report() string {
+	report, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return e.Error()
+	}
+	return string(report)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+// newChain returns a chain of interactions whose requests differ in their
+// body.
+func newChain(t *testing.T, cfg *config.EndpointConfig) []*store.RecordInteraction {
+	t.Helper()
+	var interactions []*store.RecordInteraction
+	previousRequest := store.HeadSHA
+	for _, name := range []string{"a", "b", "c"} {
+		interaction := newInteraction(t, cfg, &store.RecordedRequest{
+			Method:          "POST",
+			URL:             "/v1/echo",
+			Headers:         map[string]string{"User-Agent": "sdk/1.0"},
+			BodySegments:    []any{map[string]any{"name": name, "index": float64(len(interactions))}},
+			PreviousRequest: previousRequest,
+		}, &store.RecordedResponse{StatusCode: http.StatusOK})
+		interactions = append(interactions, interaction)
+		previousRequest = interaction.SHASum
+	}
+	return interactions
+}
+
+func TestNewMismatchError(t *testing.T) {
+	cfg := &config.EndpointConfig{Match: &config.MatchConfig{Method: true, Path: true, Body: true}}
+	matcher, err := store.NewMatcher(cfg)
+	require.NoError(t, err)
+	interactions := newChain(t, cfg)
+
+	// The request has the content of the last interaction but comes right
+	// after the first one, from a newer client.
+	req := &store.RecordedRequest{
+		Method:          "POST",
+		URL:             "/v1/echo",
+		Headers:         map[string]string{"User-Agent": "sdk/2.0"},
+		BodySegments:    []any{map[string]any{"name": "c", "index": 2.0}},
+		PreviousRequest: interactions[0].SHASum,
+	}
+
+	t.Run("Ordered", func(t *testing.T) {
+		mismatch := newMismatchError(matcher, "test.json", "sum", req, interactions, false)
+		require.Equal(t, &MismatchError{
+			File:   "test.json",
+			ShaSum: "sum",
+			ExpectedNext: &InteractionDiff{
+				Index:  1,
+				ShaSum: interactions[1].SHASum,
+				Diffs: []store.FieldDiff{
+					{Field: "bodySegments[0].index", Recorded: 1.0, Actual: 2.0},
+					{Field: "bodySegments[0].name", Recorded: "b", Actual: "c"},
+				},
+			},
+			Nearest: &InteractionDiff{
+				Index:  2,
+				ShaSum: interactions[2].SHASum,
+				Diffs: []store.FieldDiff{
+					{Field: "previousRequest", Recorded: interactions[1].SHASum, Actual: interactions[0].SHASum},
+				},
+			},
+		}, mismatch)
+	})
+
+	t.Run("Unordered", func(t *testing.T) {
+		unordered := *req
+		unordered.BodySegments = []any{map[string]any{"name": "c", "index": 3.0}}
+		mismatch := newMismatchError(matcher, "test.json", "sum", &unordered, interactions, true)
+		require.Nil(t, mismatch.ExpectedNext)
+		require.Equal(t, &InteractionDiff{
+			Index:  2,
+			ShaSum: interactions[2].SHASum,
+			Diffs:  []store.FieldDiff{{Field: "bodySegments[0].index", Recorded: 2.0, Actual: 3.0}},
+		}, mismatch.Nearest)
+	})
+}
@@ -18,27 +18,32 @@ package replay
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/google/test-server/internal/config"
 	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/store"
 )
 
 // Replay serves recorded responses for HTTP requests
 func Replay(cfg *config.TestServerConfig, recordingDir string, redactor *redact.Redact) error {
-	// Validate recording directory exists
-	if _, err := os.Stat(recordingDir); os.IsNotExist(err) {
-		return fmt.Errorf("recording directory does not exist: %s", recordingDir)
+	// The recordings are either a directory or a read-only archive.
+	storage, err := store.OpenStorage(recordingDir)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Replaying from directory: %s\n", recordingDir)
+	fmt.Printf("Replaying from: %s\n", recordingDir)
 
 	// Start a server for each endpoint
 	errChan := make(chan error, len(cfg.Endpoints))
 
 	for _, endpoint := range cfg.Endpoints {
+		server, err := NewReplayHTTPServer(&endpoint, storage, redactor)
+		if err != nil {
+			return fmt.Errorf("invalid config for %s:%d: %w",
+				endpoint.TargetHost, endpoint.TargetPort, err)
+		}
 		go func(ep config.EndpointConfig) {
-			server := NewReplayHTTPServer(&endpoint, recordingDir, redactor)
 			err := server.Start()
 			if err != nil {
 				errChan <- fmt.Errorf("replay error for %s:%d: %w",
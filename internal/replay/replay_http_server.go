@@ -17,15 +17,14 @@ limitations under the License.
 package replay
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 
 	"github.com/google/test-server/internal/config"
@@ -34,29 +33,62 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// ReplayHTTPServer serves the recorded responses of an endpoint. It handles
+// concurrent requests.
 type ReplayHTTPServer struct {
-	prevRequestSHA string
-	seenFiles      map[string]struct{}
-	config         *config.EndpointConfig
-	recordingDir   string
-	redactor       *redact.Redact
+	// mu guards chains and uses.
+	mu sync.Mutex
+	// chains holds the sha256 sum of the last request to the endpoint replayed
+	// from each file, so that every test has its own chain of requests.
+	chains map[string]string
+	// uses counts how many times the interactions matching a request content
+	// were served in unordered replay mode, keyed by file name and content sum.
+	uses map[string]int
+	// indexMu guards indexes.
+	indexMu sync.Mutex
+	// indexes caches the index of each recording file, keyed by file name.
+	indexes  map[string]*recordingIndex
+	config   *config.EndpointConfig
+	matcher  *store.Matcher
+	storage  store.Storage
+	redactor *redact.Redact
 }
 
-func NewReplayHTTPServer(cfg *config.EndpointConfig, recordingDir string, redactor *redact.Redact) *ReplayHTTPServer {
-	return &ReplayHTTPServer{
-		prevRequestSHA: store.HeadSHA,
-		seenFiles:      make(map[string]struct{}),
-		config:         cfg,
-		recordingDir:   recordingDir,
-		redactor:       redactor,
+func NewReplayHTTPServer(cfg *config.EndpointConfig, storage store.Storage, redactor *redact.Redact) (*ReplayHTTPServer, error) {
+	switch cfg.ReplayMode {
+	case "", config.ReplayModeChain, config.ReplayModeUnordered:
+	default:
+		return nil, fmt.Errorf("unknown replay_mode %q", cfg.ReplayMode)
+	}
+	switch cfg.ReplayReusePolicy {
+	case "", config.ReusePolicyNext, config.ReusePolicyRepeatLast, config.ReusePolicyFail:
+	default:
+		return nil, fmt.Errorf("unknown replay_reuse_policy %q", cfg.ReplayReusePolicy)
+	}
+	matcher, err := store.NewMatcher(cfg)
+	if err != nil {
+		return nil, err
 	}
+	redactor, err = redactor.WithConfig(cfg.Redact)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayHTTPServer{
+		chains:   make(map[string]string),
+		uses:     make(map[string]int),
+		indexes:  make(map[string]*recordingIndex),
+		config:   cfg,
+		matcher:  matcher,
+		storage:  storage,
+		redactor: redactor,
+	}, nil
 }
 
 func (r *ReplayHTTPServer) Start() error {
 	addr := fmt.Sprintf(":%d", r.config.SourcePort)
 	server := &http.Server{
 		Addr:    addr,
-		Handler: http.HandlerFunc(r.handleRequest),
+		Handler: r,
 	}
 	if err := server.ListenAndServe(); err != nil {
 		panic(err)
@@ -64,29 +96,31 @@ func (r *ReplayHTTPServer) Start() error {
 	return nil
 }
 
+// ServeHTTP answers the request with its recorded response.
+func (r *ReplayHTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handleRequest(w, req)
+}
+
 func (r *ReplayHTTPServer) handleRequest(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == r.config.Health {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	redactedReq, err := r.createRedactedRequest(req)
+	redactedReq, err := r.createRedactedRequest(req, store.HeadSHA)
 	if err != nil {
 		fmt.Printf("Error processing request")
 		http.Error(w, fmt.Sprintf("Error processing request: %v", err), http.StatusInternalServerError)
 		return
 	}
 	fmt.Printf("Replaying request: %ss\n", redactedReq.Request)
-	fileName, err := redactedReq.GetRecordingFileName()
+	fileName, err := r.matcher.RecordingFileName(redactedReq)
 	if err != nil {
 		fmt.Printf("Invalid recording file name: %v\n", err)
 		http.Error(w, fmt.Sprintf("Invalid recording file name: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if _, ok := r.seenFiles[fileName]; !ok {
-		// Reset to HeadSHA when first time seen request from the given file.
-		redactedReq.PreviousRequest = store.HeadSHA
-	}
+	redactedReq.PreviousRequest = r.chainHead(fileName)
 	if req.Header.Get("Upgrade") == "websocket" {
 		fmt.Printf("Upgrading connection to websocket...\n")
 
@@ -101,104 +135,236 @@ func (r *ReplayHTTPServer) handleRequest(w http.ResponseWriter, req *http.Reques
 		return
 	}
 	fmt.Printf("Replaying http request: %s\n", redactedReq.Request)
-	shaSum := redactedReq.ComputeSum()
-	resp, err := r.loadResponse(fileName, shaSum)
+	shaSum := r.matcher.Sum(redactedReq)
+	resp, err := r.loadResponse(fileName, shaSum, redactedReq)
+	var mismatch *MismatchError
+	if errors.As(err, &mismatch) {
+		report := mismatch.Report()
+		fmt.Printf("Error loading response: %v\n%s\n", err, report)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(report))
+		return
+	}
 	if err != nil {
 		fmt.Printf("Error loading response: %v\n", err)
 		http.Error(w, fmt.Sprintf("Error loading response: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	err = r.writeResponse(w, resp, redactedReq)
+	// Advance the chain before writing the response, as the client may send
+	// its next request as soon as it has read the response.
+	if fileName != shaSum {
+		r.mu.Lock()
+		r.chains[fileName] = shaSum
+		r.mu.Unlock()
+	}
+
+	pacer := newPacer(req.Context(), r.config.ReplayLatency, resp.Timing)
+	err = r.writeResponse(w, resp, redactedReq, pacer)
+	if errors.Is(err, context.Canceled) {
+		fmt.Printf("Request canceled while writing response\n")
+		return
+	}
 	if err != nil {
 		fmt.Printf("Error writing response: %v\n", err)
 		panic(err)
 	}
-	if fileName != shaSum {
-		r.prevRequestSHA = shaSum
+}
+
+// chainHead returns the sha256 sum of the last request replayed from the
+// file, or HeadSHA when no request was replayed from it yet.
+func (r *ReplayHTTPServer) chainHead(fileName string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if shaSum, ok := r.chains[fileName]; ok {
+		return shaSum
 	}
-	r.seenFiles[fileName] = struct{}{}
+	return store.HeadSHA
 }
 
-func (r *ReplayHTTPServer) createRedactedRequest(req *http.Request) (*store.RecordedRequest, error) {
-	recordedRequest, err := store.NewRecordedRequest(req, r.prevRequestSHA, *r.config)
+func (r *ReplayHTTPServer) createRedactedRequest(req *http.Request, prevRequestSHA string) (*store.RecordedRequest, error) {
+	recordedRequest, err := store.NewRecordedRequest(req, prevRequestSHA, *r.config)
 	if err != nil {
 		return nil, err
 	}
 
 	// Redact headers by key
 	recordedRequest.RedactHeaders(r.config.RedactRequestHeaders)
+	recordedRequest.AllowHeaders(r.config.AllowRequestHeaders)
+	recordedRequest.RedactQueryParams(r.config.RedactQueryParams, r.config.RemoveQueryParams, r.redactor)
 	// Redacts secrets from header values
 	r.redactor.Headers(recordedRequest.Headers)
 	recordedRequest.Request = r.redactor.String(recordedRequest.Request)
 	recordedRequest.URL = r.redactor.String(recordedRequest.URL)
-	var redactedBodySegments []map[string]any
+	var redactedBodySegments []any
 	for _, bodySegment := range recordedRequest.BodySegments {
-		redactedBodySegments = append(redactedBodySegments, r.redactor.Map(bodySegment))
+		redactedBodySegments = append(redactedBodySegments, r.redactor.Value(bodySegment))
 	}
 	recordedRequest.BodySegments = redactedBodySegments
+	recordedRequest.Body = recordedRequest.Body.Redact(r.redactor)
 	return recordedRequest, nil
 }
 
-func (r *ReplayHTTPServer) loadResponse(fileName string, shaSum string) (*store.RecordedResponse, error) {
-	// Open the replay log file for reading.
-	filePath := filepath.Join(r.recordingDir, fileName+".json")
+func (r *ReplayHTTPServer) loadResponse(fileName string, shaSum string, req *store.RecordedRequest) (*store.RecordedResponse, error) {
+	filePath := fileName + ".json"
 	fmt.Printf("loading response from : %s with shaSum: %s\n", filePath, shaSum)
-	file, err := os.Open(filePath)
+	index, err := r.loadIndex(fileName)
 	if err != nil {
-		return nil, fmt.Errorf("could not open file %s: %w", filePath, err)
+		return nil, err
 	}
-	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	body, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, err
+	if r.config.ReplayMode == config.ReplayModeUnordered {
+		return r.loadUnorderedResponse(fileName, filePath, index, req)
 	}
-	var recordFile store.RecordFile
-	err = json.Unmarshal(body, &recordFile)
-	if err != nil {
-		return nil, fmt.Errorf("unable to deserialize data to RecordFile: %w", err)
+
+	if interaction, ok := index.bySHA[shaSum]; ok {
+		return interaction.Response, nil
 	}
 
-	for _, interaction := range recordFile.Interactions {
-		if interaction.SHASum == shaSum {
-			return interaction.Response, nil
+	return nil, newMismatchError(r.matcher, filePath, shaSum, req, index.interactions, false)
+}
+
+// endpointInteractions returns the interactions recorded for the endpoint.
+// Interactions without an endpoint come from recordings made before files
+// were shared between endpoints and are kept.
+func (r *ReplayHTTPServer) endpointInteractions(interactions []*store.RecordInteraction) []*store.RecordInteraction {
+	endpoint := store.EndpointName(r.config)
+	var filtered []*store.RecordInteraction
+	for _, interaction := range interactions {
+		if interaction.Endpoint == "" || interaction.Endpoint == endpoint {
+			filtered = append(filtered, interaction)
 		}
 	}
+	return filtered
+}
+
+// loadUnorderedResponse finds the interactions whose request has the same
+// content as req, regardless of their position in the chain, and picks one
+// according to the endpoint's reuse policy.
+func (r *ReplayHTTPServer) loadUnorderedResponse(fileName string, filePath string, index *recordingIndex, req *store.RecordedRequest) (*store.RecordedResponse, error) {
+	contentSum := r.matcher.ContentSum(req)
+	candidates := index.byContent[contentSum]
+	if len(candidates) == 0 {
+		return nil, newMismatchError(r.matcher, filePath, contentSum, req, index.interactions, true)
+	}
 
-	return nil, fmt.Errorf("response with shaSum %s not found in file", shaSum)
+	key := fileName + "/" + contentSum
+	r.mu.Lock()
+	used := r.uses[key]
+	r.uses[key] = used + 1
+	r.mu.Unlock()
+	if used < len(candidates) {
+		return candidates[used].Response, nil
+	}
+	switch r.config.ReplayReusePolicy {
+	case config.ReusePolicyRepeatLast:
+		return candidates[len(candidates)-1].Response, nil
+	case config.ReusePolicyFail:
+		return nil, fmt.Errorf("all %d interactions matching shaSum %s in %s were already served", len(candidates), contentSum, filePath)
+	default:
+		return candidates[used%len(candidates)].Response, nil
+	}
 }
 
-func (r *ReplayHTTPServer) writeResponse(w http.ResponseWriter, resp *store.RecordedResponse, req *store.RecordedRequest) error {
-	for key, value := range resp.Headers {
-		if key == "Content-Length" || key == "Content-Encoding" {
+func (r *ReplayHTTPServer) writeResponse(w http.ResponseWriter, resp *store.RecordedResponse, req *store.RecordedRequest, pacer *pacer) error {
+	for key, values := range resp.Headers {
+		if key == "Content-Length" {
+			continue
+		}
+		// Bodies are stored decoded, unless their encoding is not supported.
+		if key == "Content-Encoding" && store.DecodedContentEncoding(strings.Join(values, ", ")) {
 			continue
 		}
-		w.Header().Add(key, value)
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	// The Content-Type header may have been left out of the recording.
+	if w.Header().Get("Content-Type") == "" {
+		if resp.Body != nil && resp.Body.ContentType != "" {
+			w.Header().Set("Content-Type", resp.Body.ContentType)
+		} else if len(resp.Events) > 0 {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
 	}
 
+	if err := pacer.waitFirstByte(); err != nil {
+		return err
+	}
 	w.WriteHeader(int(resp.StatusCode))
 
+	if resp.Body != nil {
+		body, err := resp.Body.Bytes()
+		if err != nil {
+			return err
+		}
+		// JSON arrays are streamed one element at a time, the way servers
+		// such as Vertex AI send them.
+		start := 0
+		if ends := store.JSONArrayElementEnds(body); len(ends) > 0 {
+			flush(w)
+			for i, end := range ends {
+				if err := pacer.waitSegment(i); err != nil {
+					return err
+				}
+				if _, err := w.Write(body[start:end]); err != nil {
+					return err
+				}
+				flush(w)
+				start = end
+			}
+		}
+		if err := pacer.waitBody(); err != nil {
+			return err
+		}
+		_, err = w.Write(body[start:])
+		return err
+	}
+
+	if len(resp.Events) > 0 {
+		flush(w)
+		for i, event := range resp.Events {
+			if err := pacer.waitSegment(i); err != nil {
+				return err
+			}
+			if _, err := w.Write(event.Bytes()); err != nil {
+				return err
+			}
+			flush(w)
+		}
+		return nil
+	}
+
 	// When the response body is empty we return directly with the headers.
 	if len(resp.BodySegments) == 0 {
 		return nil
 	}
 
-	if !strings.Contains(req.URL, "alt=sse") {
+	// Recordings made before events were recorded keep the JSON data of
+	// streamed responses as body segments.
+	streamed := strings.Contains(req.URL, "alt=sse") || store.IsEventStream(resp.Headers.Get("Content-Type"))
+	if !streamed {
 		jsonBytes, err := json.Marshal(resp.BodySegments[0])
 		if err != nil {
 			return err
 		}
+		if err := pacer.waitBody(); err != nil {
+			return err
+		}
 
 		_, err = w.Write(jsonBytes)
 		return err
 	} else {
-		for _, bodySegment := range resp.BodySegments {
+		flush(w)
+		for i, bodySegment := range resp.BodySegments {
 			jsonBytes, err := json.Marshal(bodySegment)
 			if err != nil {
 				return err
 			}
+			if err := pacer.waitSegment(i); err != nil {
+				return err
+			}
 
 			line := append([]byte("data: "), jsonBytes...)
 			line = append(line, []byte("\n\n")...)
@@ -206,12 +372,20 @@ func (r *ReplayHTTPServer) writeResponse(w http.ResponseWriter, resp *store.Reco
 			if _, err := w.Write(line); err != nil {
 				return err
 			}
+			flush(w)
 		}
 	}
 
 	return nil
 }
 
+// flush sends the data written so far to the client.
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func extractNumber(i *int, content string) (int, error) {
 	numStart := *i
 	for *i < len(content) && unicode.IsDigit(rune(content[*i])) {
@@ -240,9 +414,9 @@ func (r *ReplayHTTPServer) proxyWebsocket(w http.ResponseWriter, req *http.Reque
 }
 
 func (r *ReplayHTTPServer) loadWebsocketChunks(fileName string) ([]string, error) {
-	responseFile := filepath.Join(r.recordingDir, fileName+".websocket.log")
-	fmt.Printf("loading websocket response from : %s\n", responseFile)
-	bytes, err := os.ReadFile(responseFile)
+	endpoint := store.EndpointName(r.config)
+	fmt.Printf("loading websocket response of %s from : %s\n", endpoint, fileName)
+	bytes, err := r.storage.LoadWebsocketLog(fileName, endpoint)
 	var chunks = make([]string, 0)
 	if err != nil {
 		fmt.Printf("Error loading websocket response: %v\n", err)
@@ -283,7 +457,7 @@ func (r *ReplayHTTPServer) replayWebsocket(conn *websocket.Conn, chunks []string
 	for _, chunk := range chunks {
 		if strings.HasPrefix(chunk, ">") {
 			_, buf, err := conn.ReadMessage()
-			reqChunk := r.redactor.String(string(buf))
+			reqChunk := string(r.redactor.JSON(buf))
 			if err != nil {
 				fmt.Printf("Error reading from websocket: %v\n", err)
 				return
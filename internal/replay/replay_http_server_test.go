@@ -0,0 +1,571 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+	"github.com/google/test-server/internal/store"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStorage returns a storage holding the recording file named test with
+// the interactions.
+func newTestStorage(t *testing.T, interactions ...*store.RecordInteraction) store.Storage {
+	t.Helper()
+	storage := store.NewFsStorage(afero.NewMemMapFs())
+	require.NoError(t, storage.SaveRecordFile("test", &store.RecordFile{RecordID: "test", Interactions: interactions}))
+	return storage
+}
+
+// newInteraction returns an interaction whose request sum is computed with the
+// matcher of the endpoint. Requests without a previous request start a chain.
+func newInteraction(t *testing.T, cfg *config.EndpointConfig, request *store.RecordedRequest, response *store.RecordedResponse) *store.RecordInteraction {
+	t.Helper()
+	matcher, err := store.NewMatcher(cfg)
+	require.NoError(t, err)
+	if request.PreviousRequest == "" {
+		request.PreviousRequest = store.HeadSHA
+	}
+	return &store.RecordInteraction{Request: request, SHASum: matcher.Sum(request), Response: response}
+}
+
+// newTestServer starts a replay server for the endpoint serving the
+// recordings of storage.
+func newTestServer(t *testing.T, cfg *config.EndpointConfig, storage store.Storage, redactor *redact.Redact) (*ReplayHTTPServer, *httptest.Server) {
+	t.Helper()
+	replayServer, err := NewReplayHTTPServer(cfg, storage, redactor)
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(replayServer.handleRequest))
+	t.Cleanup(server.Close)
+	return replayServer, server
+}
+
+// sendRequest sends a request to the server and returns the status code and
+// body of the response. The request belongs to the test named test unless
+// header sets another Test-Name, or none when it is nil.
+func sendRequest(t *testing.T, server *httptest.Server, method, path, body string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(respBody)
+}
+
+func TestReplayHTTPServer_ConcurrentRequests(t *testing.T) {
+	const tests = 8
+	const requests = 10
+
+	storage := store.NewFsStorage(afero.NewMemMapFs())
+	for i := 0; i < tests; i++ {
+		recordFile := store.RecordFile{RecordID: fmt.Sprintf("test-%d", i)}
+		for j := 0; j < requests; j++ {
+			recordFile.Interactions = append(recordFile.Interactions, &store.RecordInteraction{
+				Request: &store.RecordedRequest{
+					Method:       "POST",
+					URL:          "/v1/echo",
+					BodySegments: []any{map[string]any{"test": float64(i), "request": float64(j)}},
+				},
+				Response: &store.RecordedResponse{
+					StatusCode:   http.StatusOK,
+					BodySegments: []map[string]any{{"echo": fmt.Sprintf("%d-%d", i, j)}},
+				},
+			})
+		}
+		require.NoError(t, storage.SaveRecordFile(recordFile.RecordID, &recordFile))
+	}
+
+	cfg := &config.EndpointConfig{
+		ReplayMode: config.ReplayModeUnordered,
+		Match:      &config.MatchConfig{Method: true, Path: true, Body: true},
+	}
+	_, server := newTestServer(t, cfg, storage, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < tests; i++ {
+		for j := 0; j < requests; j++ {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				body := fmt.Sprintf(`{"test": %d, "request": %d}`, i, j)
+				req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(body))
+				if !assert.NoError(t, err) {
+					return
+				}
+				req.Header.Set("Test-Name", fmt.Sprintf("test-%d", i))
+				resp, err := http.DefaultClient.Do(req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer resp.Body.Close()
+				respBody, err := io.ReadAll(resp.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.JSONEq(t, fmt.Sprintf(`{"echo": "%d-%d"}`, i, j), string(respBody))
+			}(i, j)
+		}
+	}
+	wg.Wait()
+}
+
+func TestReplayHTTPServer_PerTestChains(t *testing.T) {
+	cfg := &config.EndpointConfig{Match: &config.MatchConfig{Method: true, Path: true, Body: true}}
+
+	// Both tests send the same requests, so only their chains tell the
+	// recorded responses apart.
+	storage := store.NewFsStorage(afero.NewMemMapFs())
+	for _, testName := range []string{"test-a", "test-b"} {
+		recordFile := store.RecordFile{RecordID: testName}
+		previousRequest := store.HeadSHA
+		for j := 0; j < 3; j++ {
+			interaction := newInteraction(t, cfg, &store.RecordedRequest{
+				Method:          "POST",
+				URL:             "/v1/echo",
+				BodySegments:    []any{map[string]any{"request": "same"}},
+				PreviousRequest: previousRequest,
+			}, &store.RecordedResponse{
+				StatusCode:   http.StatusOK,
+				BodySegments: []map[string]any{{"echo": fmt.Sprintf("%s-%d", testName, j)}},
+			})
+			recordFile.Interactions = append(recordFile.Interactions, interaction)
+			previousRequest = interaction.SHASum
+		}
+		require.NoError(t, storage.SaveRecordFile(testName, &recordFile))
+	}
+	_, server := newTestServer(t, cfg, storage, nil)
+
+	// Interleave the requests of the two tests.
+	for j := 0; j < 3; j++ {
+		for _, testName := range []string{"test-a", "test-b"} {
+			status, body := sendRequest(t, server, "POST", "/v1/echo", `{"request": "same"}`, http.Header{"Test-Name": {testName}})
+			require.Equal(t, http.StatusOK, status)
+			require.JSONEq(t, fmt.Sprintf(`{"echo": "%s-%d"}`, testName, j), body)
+		}
+	}
+}
+
+func TestReplayHTTPServer_UnorderedReusePolicies(t *testing.T) {
+	match := &config.MatchConfig{Method: true, Path: true, Body: true}
+	// The test sent the same request three times and got a different
+	// response each time.
+	var interactions []*store.RecordInteraction
+	previousRequest := store.HeadSHA
+	for i := 1; i <= 3; i++ {
+		interaction := newInteraction(t, &config.EndpointConfig{Match: match}, &store.RecordedRequest{
+			Method:          "POST",
+			URL:             "/v1/generate",
+			BodySegments:    []any{map[string]any{"prompt": "hi"}},
+			PreviousRequest: previousRequest,
+		}, &store.RecordedResponse{
+			StatusCode:   http.StatusOK,
+			BodySegments: []map[string]any{{"response": float64(i)}},
+		})
+		interactions = append(interactions, interaction)
+		previousRequest = interaction.SHASum
+	}
+
+	testCases := []struct {
+		name     string
+		policy   string
+		expected []string
+	}{
+		{name: "Default", policy: "", expected: []string{"1", "2", "3", "1", "2"}},
+		{name: "Next", policy: config.ReusePolicyNext, expected: []string{"1", "2", "3", "1", "2"}},
+		{name: "Repeat last", policy: config.ReusePolicyRepeatLast, expected: []string{"1", "2", "3", "3", "3"}},
+		// An empty string stands for an error.
+		{name: "Fail", policy: config.ReusePolicyFail, expected: []string{"1", "2", "3", "", ""}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.EndpointConfig{ReplayMode: config.ReplayModeUnordered, ReplayReusePolicy: tc.policy, Match: match}
+			_, server := newTestServer(t, cfg, newTestStorage(t, interactions...), nil)
+			for i, expected := range tc.expected {
+				status, body := sendRequest(t, server, "POST", "/v1/generate", `{"prompt": "hi"}`, nil)
+				if expected == "" {
+					require.Equal(t, http.StatusInternalServerError, status, "request %d", i)
+					continue
+				}
+				require.Equal(t, http.StatusOK, status, "request %d", i)
+				require.JSONEq(t, fmt.Sprintf(`{"response": %s}`, expected), body, "request %d", i)
+			}
+		})
+	}
+}
+
+func TestReplayHTTPServer_SharedFile(t *testing.T) {
+	endpoints := []*config.EndpointConfig{
+		{TargetHost: "first.example.com", TargetPort: 443, Match: &config.MatchConfig{Method: true, Path: true}},
+		{TargetHost: "second.example.com", TargetPort: 443, Match: &config.MatchConfig{Method: true, Path: true}},
+	}
+
+	// Both endpoints recorded the same request into the file.
+	var interactions []*store.RecordInteraction
+	for _, endpoint := range endpoints {
+		interaction := newInteraction(t, endpoint, &store.RecordedRequest{Method: "GET", URL: "/v1/models"}, &store.RecordedResponse{
+			StatusCode:   http.StatusOK,
+			BodySegments: []map[string]any{{"host": endpoint.TargetHost}},
+		})
+		interaction.Endpoint = store.EndpointName(endpoint)
+		interactions = append(interactions, interaction)
+	}
+	storage := newTestStorage(t, interactions...)
+
+	for _, endpoint := range endpoints {
+		_, server := newTestServer(t, endpoint, storage, nil)
+		status, body := sendRequest(t, server, "GET", "/v1/models", "", nil)
+		require.Equal(t, http.StatusOK, status)
+		require.JSONEq(t, fmt.Sprintf(`{"host": %q}`, endpoint.TargetHost), body)
+	}
+}
+
+func TestReplayHTTPServer_WithoutTestName(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		Match:            &config.MatchConfig{Method: true, Path: true, Body: true},
+		IgnoreBodyFields: []string{"$.seed"},
+	}
+	request := &store.RecordedRequest{
+		Method:       "POST",
+		URL:          "/v1/echo",
+		Headers:      map[string]string{"User-Agent": "sdk/1.0"},
+		BodySegments: []any{map[string]any{"contents": "hello", "seed": 1.0}},
+	}
+	interaction := newInteraction(t, cfg, request, &store.RecordedResponse{
+		StatusCode:   http.StatusOK,
+		BodySegments: []map[string]any{{"echo": "hello"}},
+	})
+	matcher, err := store.NewMatcher(cfg)
+	require.NoError(t, err)
+	fileName, err := matcher.RecordingFileName(request)
+	require.NoError(t, err)
+	storage := store.NewFsStorage(afero.NewMemMapFs())
+	require.NoError(t, storage.SaveRecordFile(fileName, &store.RecordFile{RecordID: fileName, Interactions: []*store.RecordInteraction{interaction}}))
+	_, server := newTestServer(t, cfg, storage, nil)
+
+	// The file is found although the user agent and the ignored field changed.
+	status, body := sendRequest(t, server, "POST", "/v1/echo", `{"contents": "hello", "seed": 2}`, http.Header{
+		"Test-Name":  nil,
+		"User-Agent": {"sdk/2.0"},
+	})
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"echo": "hello"}`, body)
+}
+
+func TestReplayHTTPServer_MismatchReport(t *testing.T) {
+	cfg := &config.EndpointConfig{Match: &config.MatchConfig{Method: true, Path: true, Body: true}}
+	interactions := newChain(t, cfg)
+	_, server := newTestServer(t, cfg, newTestStorage(t, interactions...), nil)
+
+	// The second request of the chain is sent first.
+	req, err := http.NewRequest("POST", server.URL+"/v1/echo", strings.NewReader(`{"name": "b", "index": 1}`))
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var mismatch MismatchError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&mismatch))
+	require.Equal(t, "test.json", mismatch.File)
+	require.Equal(t, 0, mismatch.ExpectedNext.Index)
+	require.Equal(t, []store.FieldDiff{
+		{Field: "bodySegments[0].index", Recorded: 0.0, Actual: 1.0},
+		{Field: "bodySegments[0].name", Recorded: "a", Actual: "b"},
+	}, mismatch.ExpectedNext.Diffs)
+	require.Equal(t, 1, mismatch.Nearest.Index)
+	require.Equal(t, []store.FieldDiff{
+		{Field: "previousRequest", Recorded: interactions[0].SHASum, Actual: store.HeadSHA},
+	}, mismatch.Nearest.Diffs)
+}
+
+func TestReplayHTTPServer_VerbatimBody(t *testing.T) {
+	recordedBody := "{\n  \"id\": 9007199254740993,\n  \"z\": 1.50,\n  \"a\": [ ]\n}\n"
+	recordedResponse, err := store.NewRecordedResponse(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+	}, config.EndpointConfig{}, nil, []byte(recordedBody))
+	require.NoError(t, err)
+
+	cfg := &config.EndpointConfig{Match: &config.MatchConfig{Method: true, Path: true}}
+	storage := newTestStorage(t, newInteraction(t, cfg, &store.RecordedRequest{Method: "GET", URL: "/v1/items/1"}, recordedResponse))
+	_, server := newTestServer(t, cfg, storage, nil)
+
+	status, body := sendRequest(t, server, "GET", "/v1/items/1", "", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, recordedBody, body)
+}
+
+func TestReplayHTTPServer_EventStreamContentType(t *testing.T) {
+	// The endpoint allowed no response header, so the recording has none.
+	cfg := &config.EndpointConfig{
+		AllowResponseHeaders: []string{"X-Request-Id"},
+		Match:                &config.MatchConfig{Method: true, Path: true},
+	}
+	recordedResponse, err := store.NewRecordedResponse(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+	}, *cfg, nil, []byte("data: {\"a\": 1}\n\ndata: {\"b\": 2}\n\n"))
+	require.NoError(t, err)
+	require.Empty(t, recordedResponse.Headers)
+	require.Len(t, recordedResponse.Events, 2)
+
+	storage := newTestStorage(t, newInteraction(t, cfg, &store.RecordedRequest{Method: "GET", URL: "/v1/stream"}, recordedResponse))
+	_, server := newTestServer(t, cfg, storage, nil)
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Test-Name", "test")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Equal(t, "data: {\"a\": 1}\n\ndata: {\"b\": 2}\n\n", string(body))
+}
+
+func TestReplayHTTPServer_ContentEncoding(t *testing.T) {
+	var brotlied bytes.Buffer
+	writer := brotli.NewWriter(&brotlied)
+	writer.Write([]byte(`{"text": "hello"}`))
+	writer.Close()
+
+	testCases := []struct {
+		name             string
+		encoding         string
+		body             []byte
+		expectedEncoding string
+	}{
+		// Supported encodings are stored decoded and replayed without encoding.
+		{name: "Brotli", encoding: "br", body: brotlied.Bytes(), expectedEncoding: ""},
+		// Other encodings are replayed as received.
+		{name: "Unsupported", encoding: "compress", body: []byte{0x1f, 0x9d, 0x90}, expectedEncoding: "compress"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.EndpointConfig{
+				AllowResponseHeaders: []string{"Content-Type"},
+				Match:                &config.MatchConfig{Method: true, Path: true},
+			}
+			recordedResponse, err := store.NewRecordedResponse(&http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {tc.encoding}},
+			}, *cfg, nil, tc.body)
+			require.NoError(t, err)
+			storage := newTestStorage(t, newInteraction(t, cfg, &store.RecordedRequest{Method: "GET", URL: "/v1/items"}, recordedResponse))
+			_, server := newTestServer(t, cfg, storage, nil)
+
+			req, err := http.NewRequest("GET", server.URL+"/v1/items", nil)
+			require.NoError(t, err)
+			req.Header.Set("Test-Name", "test")
+			// Get the body as it is sent.
+			req.Header.Set("Accept-Encoding", "identity")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, tc.expectedEncoding, resp.Header.Get("Content-Encoding"))
+			if tc.expectedEncoding == "" {
+				require.JSONEq(t, `{"text": "hello"}`, string(body))
+			} else {
+				require.Equal(t, tc.body, body)
+			}
+		})
+	}
+}
+
+func TestReplayHTTPServer_Pseudonymize(t *testing.T) {
+	t.Setenv(redact.PseudonymKeyEnv, "key")
+	redactor, err := (&redact.Redact{}).WithConfig(&config.RedactConfig{
+		Patterns:     []config.RedactPattern{{Name: "bearer_token"}},
+		Pseudonymize: config.PseudonymizeHMAC,
+	})
+	require.NoError(t, err)
+
+	cfg := &config.EndpointConfig{
+		ReplayMode: config.ReplayModeUnordered,
+		Match:      &config.MatchConfig{Method: true, Path: true, Headers: []string{"Authorization"}},
+	}
+	var interactions []*store.RecordInteraction
+	for _, token := range []string{"token-a", "token-b"} {
+		interactions = append(interactions, newInteraction(t, cfg, &store.RecordedRequest{
+			Method:  "GET",
+			URL:     "/v1/whoami",
+			Headers: map[string]string{"Authorization": redactor.String("Bearer " + token)},
+		}, &store.RecordedResponse{StatusCode: http.StatusOK, Body: store.NewBody("text/plain", []byte(token))}))
+	}
+	_, server := newTestServer(t, cfg, newTestStorage(t, interactions...), redactor)
+
+	// Each token is matched to the interaction recorded with it.
+	for _, token := range []string{"token-b", "token-a"} {
+		status, body := sendRequest(t, server, "GET", "/v1/whoami", "", http.Header{"Authorization": {"Bearer " + token}})
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, token, body)
+	}
+}
+
+func TestReplayHTTPServer_RedactQueryParams(t *testing.T) {
+	cfg := &config.EndpointConfig{
+		RedactQueryParams: []string{"key"},
+		RemoveQueryParams: []string{"t"},
+		Match:             &config.MatchConfig{Method: true, Path: true, QueryParams: []string{"key", "t"}},
+	}
+	storage := newTestStorage(t, newInteraction(t, cfg,
+		&store.RecordedRequest{Method: "GET", URL: "/v1/models?key=REDACTED"},
+		&store.RecordedResponse{StatusCode: http.StatusOK, Body: store.NewBody("text/plain", []byte("ok"))}))
+	_, server := newTestServer(t, cfg, storage, nil)
+
+	// The key and the timestamp of the request do not need to be known.
+	status, body := sendRequest(t, server, "GET", "/v1/models?key=AIzaSecret&t=1234", "", nil)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, "ok", body)
+}
+
+func TestReplayHTTPServer_ReloadsChangedFile(t *testing.T) {
+	cfg := &config.EndpointConfig{}
+	request := &store.RecordedRequest{Method: "GET", URL: "/v1/models", PreviousRequest: store.HeadSHA}
+	shaSum := request.ComputeSum()
+	fs := afero.NewMemMapFs()
+	storage := store.NewFsStorage(fs)
+	modTime := time.Now().Add(-time.Hour)
+	// writeFile saves a recording file of the same size for every text of the
+	// same length, with the same modification time.
+	writeFile := func(text string) {
+		recordFile := store.RecordFile{RecordID: "test", Interactions: []*store.RecordInteraction{{
+			Request:  request,
+			SHASum:   shaSum,
+			Response: &store.RecordedResponse{StatusCode: http.StatusOK, BodySegments: []map[string]any{{"text": text}}},
+		}}}
+		require.NoError(t, storage.SaveRecordFile("test", &recordFile))
+		require.NoError(t, fs.Chtimes("/test.json", modTime, modTime))
+	}
+	loadText := func(replayServer *ReplayHTTPServer) string {
+		resp, err := replayServer.loadResponse("test", shaSum, request)
+		require.NoError(t, err)
+		return resp.BodySegments[0]["text"].(string)
+	}
+
+	t.Run("Changed file", func(t *testing.T) {
+		replayServer, err := NewReplayHTTPServer(cfg, storage, nil)
+		require.NoError(t, err)
+		writeFile("first")
+		require.Equal(t, "first", loadText(replayServer))
+		modTime = modTime.Add(time.Second)
+		writeFile("second response")
+		require.Equal(t, "second response", loadText(replayServer))
+	})
+
+	t.Run("Same size and modification time", func(t *testing.T) {
+		replayServer, err := NewReplayHTTPServer(cfg, storage, nil)
+		require.NoError(t, err)
+		// The file was loaded within racyWindow of its modification, so it
+		// is loaded again although it looks the same.
+		modTime = time.Now()
+		writeFile("first")
+		require.Equal(t, "first", loadText(replayServer))
+		writeFile("other")
+		require.Equal(t, "other", loadText(replayServer))
+	})
+
+	t.Run("Unchanged file", func(t *testing.T) {
+		replayServer, err := NewReplayHTTPServer(cfg, storage, nil)
+		require.NoError(t, err)
+		modTime = time.Now().Add(-time.Hour)
+		writeFile("first")
+		index, err := replayServer.loadIndex("test")
+		require.NoError(t, err)
+		cached, err := replayServer.loadIndex("test")
+		require.NoError(t, err)
+		require.Same(t, index, cached)
+	})
+}
+
+func BenchmarkReplayHTTPServer_LoadResponse(b *testing.B) {
+	const interactions = 1000
+	cfg := &config.EndpointConfig{}
+	matcher, err := store.NewMatcher(cfg)
+	require.NoError(b, err)
+
+	recordFile := store.RecordFile{RecordID: "bench"}
+	var requests []*store.RecordedRequest
+	previousRequest := store.HeadSHA
+	for i := 0; i < interactions; i++ {
+		request := &store.RecordedRequest{
+			Method:          "POST",
+			URL:             "/v1/generate",
+			BodySegments:    []any{map[string]any{"prompt": fmt.Sprintf("prompt %d", i)}},
+			PreviousRequest: previousRequest,
+		}
+		shaSum := matcher.Sum(request)
+		recordFile.Interactions = append(recordFile.Interactions, &store.RecordInteraction{
+			Request: request,
+			SHASum:  shaSum,
+			Response: &store.RecordedResponse{
+				StatusCode:   http.StatusOK,
+				BodySegments: []map[string]any{{"text": strings.Repeat("response text ", 100)}},
+			},
+		})
+		requests = append(requests, request)
+		previousRequest = shaSum
+	}
+	dir := b.TempDir()
+	storage := store.NewDirStorage(dir)
+	require.NoError(b, storage.SaveRecordFile("bench", &recordFile))
+	// Files modified less than racyWindow ago are not cached.
+	modTime := time.Now().Add(-time.Hour)
+	require.NoError(b, os.Chtimes(filepath.Join(dir, "bench.json"), modTime, modTime))
+
+	replayServer, err := NewReplayHTTPServer(cfg, storage, nil)
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		interaction := recordFile.Interactions[i%interactions]
+		if _, err := replayServer.loadResponse("bench", interaction.SHASum, requests[i%interactions]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
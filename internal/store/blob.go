@@ -0,0 +1,153 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/spf13/afero"
+)
+
+// Large bodies are stored as blobs, files named after the sha256 sum of their
+// content under the blobs directory. A recording references the blob holding
+// a body instead of holding the body itself, and identical bodies share one
+// blob.
+
+// requestBody holds the body fields of a RecordedRequest stored in a blob.
+type requestBody struct {
+	BodySegments []any `json:"bodySegments,omitempty"`
+	Body         *Body `json:"body,omitempty"`
+}
+
+// responseBody holds the body fields of a RecordedResponse stored in a blob.
+type responseBody struct {
+	BodySegments        []map[string]any `json:"bodySegments,omitempty"`
+	SDKResponseSegments []map[string]any `json:"sdkResponseSegments,omitempty"`
+	Body                *Body            `json:"body,omitempty"`
+	Events              []*SSEEvent      `json:"events,omitempty"`
+}
+
+var blobNamePattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func blobPath(sum string) string {
+	return "/blobs/" + sum
+}
+
+// externalizeBlobs returns a copy of the RecordFile in which the bodies larger
+// than the blob threshold are replaced by references to blobs. The blobs are
+// written to the storage.
+func (s *FsStorage) externalizeBlobs(recordFile *RecordFile) (*RecordFile, error) {
+	external := *recordFile
+	external.Interactions = make([]*RecordInteraction, len(recordFile.Interactions))
+	for i, interaction := range recordFile.Interactions {
+		copied := *interaction
+		if req := interaction.Request; req != nil {
+			sum, err := s.writeBlob(&requestBody{BodySegments: req.BodySegments, Body: req.Body})
+			if err != nil {
+				return nil, err
+			}
+			if sum != "" {
+				externalReq := *req
+				externalReq.BodySegments, externalReq.Body = nil, nil
+				externalReq.BodyBlob = sum
+				copied.Request = &externalReq
+			}
+		}
+		if resp := interaction.Response; resp != nil {
+			sum, err := s.writeBlob(&responseBody{BodySegments: resp.BodySegments, SDKResponseSegments: resp.SDKResponseSegments, Body: resp.Body, Events: resp.Events})
+			if err != nil {
+				return nil, err
+			}
+			if sum != "" {
+				externalResp := *resp
+				externalResp.BodySegments, externalResp.SDKResponseSegments, externalResp.Body, externalResp.Events = nil, nil, nil, nil
+				externalResp.BodyBlob = sum
+				copied.Response = &externalResp
+			}
+		}
+		external.Interactions[i] = &copied
+	}
+	return &external, nil
+}
+
+// writeBlob stores the body as a blob when its JSON encoding is larger than
+// the blob threshold, and returns the name of the blob. It returns an empty
+// name for smaller bodies.
+func (s *FsStorage) writeBlob(body any) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	if len(data) <= s.BlobThreshold {
+		return "", nil
+	}
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+	if _, err := s.fs.Stat(blobPath(sum)); err == nil {
+		return sum, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := s.writeFileAtomic(blobPath(sum), data); err != nil {
+		return "", fmt.Errorf("failed to write blob %s: %w", sum, err)
+	}
+	return sum, nil
+}
+
+// internalizeBlobs replaces the blob references of the RecordFile by the
+// bodies stored in the blobs.
+func (s *FsStorage) internalizeBlobs(recordFile *RecordFile) error {
+	for _, interaction := range recordFile.Interactions {
+		if req := interaction.Request; req != nil && req.BodyBlob != "" {
+			var body requestBody
+			if err := s.readBlob(req.BodyBlob, &body); err != nil {
+				return err
+			}
+			req.BodySegments, req.Body = body.BodySegments, body.Body
+			req.BodyBlob = ""
+		}
+		if resp := interaction.Response; resp != nil && resp.BodyBlob != "" {
+			var body responseBody
+			if err := s.readBlob(resp.BodyBlob, &body); err != nil {
+				return err
+			}
+			resp.BodySegments, resp.SDKResponseSegments, resp.Body, resp.Events = body.BodySegments, body.SDKResponseSegments, body.Body, body.Events
+			resp.BodyBlob = ""
+		}
+	}
+	return nil
+}
+
+func (s *FsStorage) readBlob(sum string, body any) error {
+	if !blobNamePattern.MatchString(sum) {
+		return fmt.Errorf("invalid blob reference %q", sum)
+	}
+	data, err := afero.ReadFile(s.fs, blobPath(sum))
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", sum, err)
+	}
+	if err := json.Unmarshal(data, body); err != nil {
+		return fmt.Errorf("unable to deserialize blob %s: %w", sum, err)
+	}
+	return nil
+}
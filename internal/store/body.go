@@ -0,0 +1,134 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/test-server/internal/redact"
+)
+
+// Encodings of the data of a Body.
+const (
+	BodyEncodingText   = "text"
+	BodyEncodingBase64 = "base64"
+)
+
+// Body holds a payload that is not stored as JSON body segments, such as form
+// posts, multipart uploads, plain text or protobuf.
+type Body struct {
+	ContentType string `json:"contentType,omitempty"`
+	Encoding    string `json:"encoding"`
+	Data        string `json:"data"`
+}
+
+// MultipartBoundary replaces the boundary of multipart request bodies, which
+// clients pick at random, so that a re-sent upload matches its recording.
+const MultipartBoundary = "test-server-boundary"
+
+// normalizeMultipart replaces the boundary of a multipart payload and of its
+// content type with MultipartBoundary. Other payloads are returned unchanged.
+func normalizeMultipart(contentType string, data []byte) (string, []byte) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return contentType, data
+	}
+	boundary := params["boundary"]
+	params["boundary"] = MultipartBoundary
+	data = bytes.ReplaceAll(data, []byte("--"+boundary), []byte("--"+MultipartBoundary))
+	return mime.FormatMediaType(mediaType, params), data
+}
+
+// binaryContentTypes are stored as base64 even when the payload happens to be
+// valid UTF-8.
+var binaryContentTypes = []string{
+	"application/octet-stream",
+	"application/protobuf",
+	"application/x-protobuf",
+	"application/grpc",
+	"application/zip",
+	"application/gzip",
+	"application/pdf",
+	"image/",
+	"audio/",
+	"video/",
+}
+
+// NewBody creates a Body from a payload. The payload is stored as text when
+// it is valid UTF-8 and its content type is not a binary one, as base64
+// otherwise.
+func NewBody(contentType string, data []byte) *Body {
+	body := &Body{ContentType: contentType}
+	if utf8.Valid(data) && !isBinaryContentType(contentType) {
+		body.Encoding = BodyEncodingText
+		body.Data = string(data)
+	} else {
+		body.Encoding = BodyEncodingBase64
+		body.Data = base64.StdEncoding.EncodeToString(data)
+	}
+	return body
+}
+
+func isBinaryContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	for _, binary := range binaryContentTypes {
+		if strings.HasPrefix(mediaType, binary) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes returns the decoded payload.
+func (b *Body) Bytes() ([]byte, error) {
+	switch b.Encoding {
+	case BodyEncodingText:
+		return []byte(b.Data), nil
+	case BodyEncodingBase64:
+		return base64.StdEncoding.DecodeString(b.Data)
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q", b.Encoding)
+	}
+}
+
+// Redact returns a copy of the body with the secrets redacted. The redacted
+// fields of a text body holding a JSON document are redacted too.
+func (b *Body) Redact(redactor *redact.Redact) *Body {
+	if b == nil {
+		return nil
+	}
+	redacted := *b
+	switch b.Encoding {
+	case BodyEncodingText:
+		redacted.Data = string(redactor.JSON([]byte(b.Data)))
+	case BodyEncodingBase64:
+		data, err := b.Bytes()
+		if err != nil {
+			return &redacted
+		}
+		redacted.Data = base64.StdEncoding.EncodeToString(redactor.Bytes(data))
+	}
+	return &redacted
+}
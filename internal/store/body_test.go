@@ -0,0 +1,86 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/google/test-server/internal/redact"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBody(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		data        []byte
+		expected    *Body
+	}{
+		{
+			name:        "Plain text",
+			contentType: "text/plain; charset=utf-8",
+			data:        []byte("hello"),
+			expected:    &Body{ContentType: "text/plain; charset=utf-8", Encoding: BodyEncodingText, Data: "hello"},
+		},
+		{
+			name:        "Invalid UTF-8",
+			contentType: "text/plain",
+			data:        []byte{0xff, 0xfe},
+			expected:    &Body{ContentType: "text/plain", Encoding: BodyEncodingBase64, Data: "//4="},
+		},
+		{
+			name:        "Binary content type",
+			contentType: "application/octet-stream",
+			data:        []byte("abc"),
+			expected:    &Body{ContentType: "application/octet-stream", Encoding: BodyEncodingBase64, Data: "YWJj"},
+		},
+		{
+			name:        "Missing content type",
+			contentType: "",
+			data:        []byte("abc"),
+			expected:    &Body{Encoding: BodyEncodingText, Data: "abc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := NewBody(tc.contentType, tc.data)
+			require.Equal(t, tc.expected, body)
+
+			data, err := body.Bytes()
+			require.NoError(t, err)
+			require.Equal(t, tc.data, data)
+		})
+	}
+}
+
+func TestBody_Redact(t *testing.T) {
+	redactor, err := redact.NewRedact([]string{"secret"})
+	require.NoError(t, err)
+
+	text := NewBody("text/plain", []byte("token=secret"))
+	require.Equal(t, "token=REDACTED", text.Redact(redactor).Data)
+	require.Equal(t, "token=secret", text.Data, "input body was modified")
+
+	binary := NewBody("application/octet-stream", []byte("token=secret"))
+	data, err := binary.Redact(redactor).Bytes()
+	require.NoError(t, err)
+	require.Equal(t, []byte("token=REDACTED"), data)
+
+	var missing *Body
+	require.Nil(t, missing.Redact(redactor))
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// FieldDiff describes a field that differs between a recorded and an incoming request.
+type FieldDiff struct {
+	Field    string `json:"field"`
+	Recorded any    `json:"recorded,omitempty"`
+	Actual   any    `json:"actual,omitempty"`
+}
+
+// DiffRequests compares a recorded request with an incoming request field by
+// field, covering every field hashed by RecordedRequest.ComputeSum. Body
+// differences are reported by their JSON path.
+func DiffRequests(recorded, actual *RecordedRequest) []FieldDiff {
+	var diffs []FieldDiff
+	if recorded.Method != actual.Method {
+		diffs = append(diffs, FieldDiff{Field: "method", Recorded: recorded.Method, Actual: actual.Method})
+	}
+	if recorded.URL != actual.URL {
+		diffs = append(diffs, FieldDiff{Field: "url", Recorded: recorded.URL, Actual: actual.URL})
+	}
+	if recorded.Request != actual.Request {
+		diffs = append(diffs, FieldDiff{Field: "request", Recorded: recorded.Request, Actual: actual.Request})
+	}
+
+	for _, name := range unionKeys(recorded.Headers, actual.Headers) {
+		recordedValue, inRecorded := recorded.Headers[name]
+		actualValue, inActual := actual.Headers[name]
+		if inRecorded != inActual || recordedValue != actualValue {
+			diffs = append(diffs, FieldDiff{Field: "headers." + name, Recorded: optional(recordedValue, inRecorded), Actual: optional(actualValue, inActual)})
+		}
+	}
+
+	diffs = diffValues("bodySegments", bodySegments(recorded), bodySegments(actual), diffs)
+	if !reflect.DeepEqual(recorded.Body, actual.Body) {
+		diffs = append(diffs, FieldDiff{Field: "body", Recorded: recorded.Body, Actual: actual.Body})
+	}
+
+	if recorded.PreviousRequest != actual.PreviousRequest {
+		diffs = append(diffs, FieldDiff{Field: "previousRequest", Recorded: recorded.PreviousRequest, Actual: actual.PreviousRequest})
+	}
+	if recorded.ServerAddress != actual.ServerAddress {
+		diffs = append(diffs, FieldDiff{Field: "serverAddress", Recorded: recorded.ServerAddress, Actual: actual.ServerAddress})
+	}
+	if recorded.Port != actual.Port {
+		diffs = append(diffs, FieldDiff{Field: "port", Recorded: recorded.Port, Actual: actual.Port})
+	}
+	if recorded.Protocol != actual.Protocol {
+		diffs = append(diffs, FieldDiff{Field: "protocol", Recorded: recorded.Protocol, Actual: actual.Protocol})
+	}
+	return diffs
+}
+
+// bodySegments returns the body segments of the request as a decoded JSON
+// value. A request without a body may hold no segment or a single null one,
+// which are not reported as different.
+func bodySegments(r *RecordedRequest) any {
+	for _, segment := range r.BodySegments {
+		if segment != nil {
+			return r.BodySegments
+		}
+	}
+	return []any{}
+}
+
+// diffValues appends the differences between two decoded JSON values to diffs.
+func diffValues(path string, recorded, actual any, diffs []FieldDiff) []FieldDiff {
+	switch r := recorded.(type) {
+	case map[string]any:
+		if a, ok := actual.(map[string]any); ok {
+			for _, key := range unionKeys(r, a) {
+				recordedValue, inRecorded := r[key]
+				actualValue, inActual := a[key]
+				if inRecorded != inActual {
+					diffs = append(diffs, FieldDiff{Field: path + "." + key, Recorded: recordedValue, Actual: actualValue})
+					continue
+				}
+				diffs = diffValues(path+"."+key, recordedValue, actualValue, diffs)
+			}
+			return diffs
+		}
+	case []any:
+		if a, ok := actual.([]any); ok {
+			for i := 0; i < len(r) || i < len(a); i++ {
+				elementPath := fmt.Sprintf("%s[%d]", path, i)
+				switch {
+				case i >= len(a):
+					diffs = append(diffs, FieldDiff{Field: elementPath, Recorded: r[i]})
+				case i >= len(r):
+					diffs = append(diffs, FieldDiff{Field: elementPath, Actual: a[i]})
+				default:
+					diffs = diffValues(elementPath, r[i], a[i], diffs)
+				}
+			}
+			return diffs
+		}
+	}
+	if !reflect.DeepEqual(recorded, actual) {
+		diffs = append(diffs, FieldDiff{Field: path, Recorded: recorded, Actual: actual})
+	}
+	return diffs
+}
+
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func optional(value string, ok bool) any {
+	if !ok {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffRequests(t *testing.T) {
+	recorded := &RecordedRequest{
+		Method: "POST",
+		URL:    "/v1/models/gemini:generateContent",
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"User-Agent":   "sdk/1.0",
+		},
+		BodySegments: []any{map[string]any{
+			"contents":         []any{map[string]any{"text": "hi"}},
+			"generationConfig": map[string]any{"seed": 1.0},
+		}},
+		PreviousRequest: HeadSHA,
+		ServerAddress:   "generativelanguage.googleapis.com",
+		Port:            443,
+		Protocol:        "https",
+	}
+
+	testCases := []struct {
+		name     string
+		actual   *RecordedRequest
+		expected []FieldDiff
+	}{
+		{
+			name: "Identical requests",
+			actual: &RecordedRequest{
+				Method:          "POST",
+				URL:             "/v1/models/gemini:generateContent",
+				Headers:         map[string]string{"Content-Type": "application/json", "User-Agent": "sdk/1.0"},
+				BodySegments:    []any{map[string]any{"contents": []any{map[string]any{"text": "hi"}}, "generationConfig": map[string]any{"seed": 1.0}}},
+				PreviousRequest: HeadSHA,
+				ServerAddress:   "generativelanguage.googleapis.com",
+				Port:            443,
+				Protocol:        "https",
+			},
+			expected: nil,
+		},
+		{
+			name: "Every field differs",
+			actual: &RecordedRequest{
+				Method:          "GET",
+				URL:             "/v1/models",
+				Headers:         map[string]string{"Content-Type": "application/json", "User-Agent": "sdk/2.0", "Accept": "*/*"},
+				BodySegments:    []any{map[string]any{"contents": []any{map[string]any{"text": "bye"}, "extra"}, "stream": true}},
+				PreviousRequest: "other",
+				ServerAddress:   "localhost",
+				Port:            8080,
+				Protocol:        "http",
+			},
+			expected: []FieldDiff{
+				{Field: "method", Recorded: "POST", Actual: "GET"},
+				{Field: "url", Recorded: "/v1/models/gemini:generateContent", Actual: "/v1/models"},
+				{Field: "headers.Accept", Recorded: nil, Actual: "*/*"},
+				{Field: "headers.User-Agent", Recorded: "sdk/1.0", Actual: "sdk/2.0"},
+				{Field: "bodySegments[0].contents[0].text", Recorded: "hi", Actual: "bye"},
+				{Field: "bodySegments[0].contents[1]", Recorded: nil, Actual: "extra"},
+				{Field: "bodySegments[0].generationConfig", Recorded: map[string]any{"seed": 1.0}, Actual: nil},
+				{Field: "bodySegments[0].stream", Recorded: nil, Actual: true},
+				{Field: "previousRequest", Recorded: HeadSHA, Actual: "other"},
+				{Field: "serverAddress", Recorded: "generativelanguage.googleapis.com", Actual: "localhost"},
+				{Field: "port", Recorded: int64(443), Actual: int64(8080)},
+				{Field: "protocol", Recorded: "https", Actual: "http"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, DiffRequests(recorded, tc.actual))
+		})
+	}
+
+	t.Run("Requests without a body", func(t *testing.T) {
+		withoutSegments := &RecordedRequest{Method: "GET", URL: "/v1/models"}
+		withNullSegment := &RecordedRequest{Method: "GET", URL: "/v1/models", BodySegments: []any{nil}}
+		require.Empty(t, DiffRequests(withoutSegments, withNullSegment))
+	})
+}
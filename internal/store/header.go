@@ -0,0 +1,112 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Header holds recorded header values, keeping every value of a header
+// separately and in the order they were received. A header with a single
+// value is serialized as a string and a header with several values as an
+// array of strings, so recordings that stored every header as a string are
+// still readable.
+type Header map[string][]string
+
+// NewHeader creates a Header from an http.Header.
+func NewHeader(header http.Header) Header {
+	h := make(Header, len(header))
+	for key, values := range header {
+		h[key] = append([]string(nil), values...)
+	}
+	return h
+}
+
+// Filter removes the headers listed in remove and, when allow is not empty,
+// every header not listed in allow. Header names are case-insensitive.
+func (h Header) Filter(allow, remove []string) {
+	allowed := headerSet(allow)
+	removed := headerSet(remove)
+	for key := range h {
+		name := http.CanonicalHeaderKey(key)
+		if removed[name] || (len(allowed) > 0 && !allowed[name]) {
+			delete(h, key)
+		}
+	}
+}
+
+// headerSet returns the canonical form of the header names.
+func headerSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
+
+// Get returns the first value of the header, or "" when it is not set.
+func (h Header) Get(key string) string {
+	if values := h[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h Header) MarshalJSON() ([]byte, error) {
+	if h == nil {
+		return []byte("null"), nil
+	}
+	serialized := make(map[string]any, len(h))
+	for key, values := range h {
+		if len(values) == 1 {
+			serialized[key] = values[0]
+		} else {
+			serialized[key] = values
+		}
+	}
+	return json.Marshal(serialized)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *Header) UnmarshalJSON(data []byte) error {
+	var serialized map[string]json.RawMessage
+	if err := json.Unmarshal(data, &serialized); err != nil {
+		return err
+	}
+	if serialized == nil {
+		*h = nil
+		return nil
+	}
+	header := make(Header, len(serialized))
+	for key, raw := range serialized {
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			header[key] = []string{value}
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return fmt.Errorf("invalid value for header %s: %w", key, err)
+		}
+		header[key] = values
+	}
+	*h = header
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeader_MarshalJSON(t *testing.T) {
+	header := NewHeader(http.Header{
+		"Content-Type": {"application/json"},
+		"Set-Cookie":   {"a=1; Expires=Wed, 21 Oct 2025 07:28:00 GMT", "b=2"},
+	})
+
+	serialized, err := json.Marshal(header)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Content-Type": "application/json", "Set-Cookie": ["a=1; Expires=Wed, 21 Oct 2025 07:28:00 GMT", "b=2"]}`, string(serialized))
+
+	var deserialized Header
+	require.NoError(t, json.Unmarshal(serialized, &deserialized))
+	require.Equal(t, header, deserialized)
+}
+
+func TestHeader_UnmarshalJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected Header
+		wantErr  bool
+	}{
+		{
+			name:     "Headers stored as strings",
+			input:    `{"Vary": "Origin, X-Origin", "Content-Type": "text/html"}`,
+			expected: Header{"Vary": {"Origin, X-Origin"}, "Content-Type": {"text/html"}},
+		},
+		{
+			name:     "Headers stored as arrays",
+			input:    `{"Vary": ["Origin", "X-Origin"]}`,
+			expected: Header{"Vary": {"Origin", "X-Origin"}},
+		},
+		{
+			name:     "Null headers",
+			input:    `null`,
+			expected: nil,
+		},
+		{
+			name:    "Invalid header value",
+			input:   `{"Vary": 1}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var header Header
+			err := json.Unmarshal([]byte(tc.input), &header)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, header)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// JSONArrayElementEnds returns, for each element of a body holding a JSON
+// array, the offset in body right after the element. Servers such as Vertex AI
+// stream their responses as a JSON array sent one element at a time. It
+// returns nil when the body is not a JSON array.
+func JSONArrayElementEnds(body []byte) []int {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if _, err := decoder.Token(); err != nil {
+		return nil
+	}
+	var ends []int
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			return nil
+		}
+		ends = append(ends, int(decoder.InputOffset()))
+	}
+	if token, err := decoder.Token(); err != nil || token != json.Delim(']') {
+		return nil
+	}
+	return ends
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONArrayElementEnds(t *testing.T) {
+	testCases := []struct {
+		name     string
+		body     string
+		expected []int
+	}{
+		{name: "Streamed array", body: "[{\"a\": 1}\n,\r\n{\"b\": [2, 3]}\n]", expected: []int{9, 26}},
+		{name: "Scalars", body: ` [1, "two", null]`, expected: []int{3, 10, 16}},
+		{name: "Empty array", body: "[]", expected: nil},
+		{name: "Object", body: `{"a": [1]}`, expected: nil},
+		{name: "Truncated array", body: `[{"a": 1},`, expected: nil},
+		{name: "Not JSON", body: "[not json]", expected: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, JSONArrayElementEnds([]byte(tc.body)))
+		})
+	}
+}
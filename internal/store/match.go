@@ -0,0 +1,220 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/jsonpath"
+)
+
+// Matcher computes the key used to find the recorded interaction of a request.
+type Matcher struct {
+	match      *config.MatchConfig
+	ignoreBody []*jsonpath.Path
+}
+
+// matchKey holds the parts of a request selected by a MatchConfig.
+type matchKey struct {
+	Method          string              `json:"method,omitempty"`
+	Path            string              `json:"path,omitempty"`
+	QueryParams     map[string][]string `json:"queryParams,omitempty"`
+	Headers         map[string]string   `json:"headers,omitempty"`
+	BodySegments    []any               `json:"bodySegments,omitempty"`
+	Body            *Body               `json:"body,omitempty"`
+	PreviousRequest string              `json:"previousRequest,omitempty"`
+}
+
+// NewMatcher creates a Matcher for the given endpoint.
+// It returns an error when one of the ignored body fields is not a valid JSONPath.
+func NewMatcher(cfg *config.EndpointConfig) (*Matcher, error) {
+	matcher := &Matcher{match: cfg.Match}
+	for _, field := range cfg.IgnoreBodyFields {
+		path, err := jsonpath.Parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore_body_fields entry: %w", err)
+		}
+		matcher.ignoreBody = append(matcher.ignoreBody, path)
+	}
+	return matcher, nil
+}
+
+// Sum computes the SHA256 sum of the parts of the request selected by the
+// endpoint's match config, after removing the ignored body fields. Without a
+// match config or ignored fields it is the same as RecordedRequest.ComputeSum.
+func (m *Matcher) Sum(r *RecordedRequest) string {
+	if m == nil {
+		return r.ComputeSum()
+	}
+	if len(m.ignoreBody) > 0 {
+		// Work on a copy so the recorded request keeps the raw values.
+		filtered := *r
+		filtered.BodySegments = m.filterBody(r.BodySegments)
+		r = &filtered
+	}
+	if m.match == nil {
+		return r.ComputeSum()
+	}
+
+	key := matchKey{PreviousRequest: r.PreviousRequest}
+	if m.match.Method {
+		key.Method = r.Method
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		fmt.Printf("unable to parse recorded request url %s: %v\n", r.URL, err)
+		u = &url.URL{}
+	}
+	if m.match.Path {
+		key.Path = u.Path
+	}
+	if len(m.match.QueryParams) > 0 {
+		query := u.Query()
+		key.QueryParams = make(map[string][]string)
+		for _, name := range m.match.QueryParams {
+			if values, ok := query[name]; ok {
+				key.QueryParams[name] = values
+			}
+		}
+	}
+	if len(m.match.Headers) > 0 {
+		key.Headers = make(map[string]string)
+		for _, name := range m.match.Headers {
+			name = http.CanonicalHeaderKey(name)
+			if value, ok := r.Headers[name]; ok {
+				key.Headers[name] = value
+			}
+		}
+	}
+	if m.match.Body {
+		key.BodySegments = r.BodySegments
+		key.Body = r.Body
+	}
+
+	serialized, err := json.Marshal(key)
+	if err != nil {
+		fmt.Printf("unable to serialize match key: %s", err)
+		return ""
+	}
+	hash := sha256.Sum256(serialized)
+	return hex.EncodeToString(hash[:])
+}
+
+// ContentSum is like Sum but ignores the request's position in the chain of
+// previous requests.
+func (m *Matcher) ContentSum(r *RecordedRequest) string {
+	unchained := *r
+	unchained.PreviousRequest = ""
+	return m.Sum(&unchained)
+}
+
+// DiffRequests is like the DiffRequests function but only compares the parts
+// of the requests used by Sum, so that the differences explain why the sums
+// differ.
+func (m *Matcher) DiffRequests(recorded, actual *RecordedRequest) []FieldDiff {
+	return DiffRequests(m.selectRequest(recorded), m.selectRequest(actual))
+}
+
+// selectRequest returns a copy of the request holding only the parts used by
+// Sum.
+func (m *Matcher) selectRequest(r *RecordedRequest) *RecordedRequest {
+	if m == nil {
+		return r
+	}
+	selected := *r
+	if len(m.ignoreBody) > 0 {
+		selected.BodySegments = m.filterBody(r.BodySegments)
+	}
+	if m.match == nil {
+		return &selected
+	}
+
+	// The request line, server and protocol are only hashed without a match
+	// config.
+	selected.Request = ""
+	selected.ServerAddress = ""
+	selected.Port = 0
+	selected.Protocol = ""
+	if !m.match.Method {
+		selected.Method = ""
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		u = &url.URL{}
+	}
+	selectedURL := url.URL{}
+	if m.match.Path {
+		selectedURL.Path = u.Path
+	}
+	if len(m.match.QueryParams) > 0 {
+		query := u.Query()
+		selectedQuery := url.Values{}
+		for _, name := range m.match.QueryParams {
+			if values, ok := query[name]; ok {
+				selectedQuery[name] = values
+			}
+		}
+		selectedURL.RawQuery = selectedQuery.Encode()
+	}
+	selected.URL = selectedURL.String()
+	selected.Headers = make(map[string]string)
+	for _, name := range m.match.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if value, ok := r.Headers[name]; ok {
+			selected.Headers[name] = value
+		}
+	}
+	if !m.match.Body {
+		selected.BodySegments = nil
+		selected.Body = nil
+	}
+	return &selected
+}
+
+// RecordingFileName returns the name of the file recording the request. It
+// is the Test-Name header or, without one, the Sum of the request at the head
+// of a chain, so that the parts of the request that are not matched, such as
+// the User-Agent, do not change the file.
+func (m *Matcher) RecordingFileName(r *RecordedRequest) (string, error) {
+	if r.Headers["Test-Name"] != "" {
+		return r.GetRecordingFileName()
+	}
+	head := *r
+	head.PreviousRequest = HeadSHA
+	return m.Sum(&head), nil
+}
+
+// filterBody returns copies of the body segments without the ignored fields.
+func (m *Matcher) filterBody(segments []any) []any {
+	if segments == nil {
+		return nil
+	}
+	filtered := make([]any, len(segments))
+	for i, segment := range segments {
+		for _, path := range m.ignoreBody {
+			segment = path.Delete(segment)
+		}
+		filtered[i] = segment
+	}
+	return filtered
+}
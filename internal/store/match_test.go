@@ -0,0 +1,327 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/google/test-server/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher_Sum(t *testing.T) {
+	base := RecordedRequest{
+		Method:  "POST",
+		URL:     "/v1/models/gemini:generateContent?alt=sse&key=abc",
+		Request: "POST /v1/models/gemini:generateContent?alt=sse&key=abc HTTP/1.1",
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"User-Agent":   "sdk/1.0",
+		},
+		BodySegments:    []any{map[string]any{"contents": "hello"}},
+		PreviousRequest: HeadSHA,
+		ServerAddress:   "example.com",
+		Port:            443,
+		Protocol:        "https",
+	}
+
+	testCases := []struct {
+		name      string
+		match     *config.MatchConfig
+		modify    func(r *RecordedRequest)
+		wantEqual bool
+	}{
+		{
+			name:      "Default matcher uses the whole request",
+			match:     nil,
+			modify:    func(r *RecordedRequest) { r.Headers["User-Agent"] = "sdk/2.0" },
+			wantEqual: false,
+		},
+		{
+			name:      "Unselected header is ignored",
+			match:     &config.MatchConfig{Method: true, Path: true, Body: true},
+			modify:    func(r *RecordedRequest) { r.Headers["User-Agent"] = "sdk/2.0" },
+			wantEqual: true,
+		},
+		{
+			name:      "Selected header is compared",
+			match:     &config.MatchConfig{Method: true, Path: true, Headers: []string{"user-agent"}},
+			modify:    func(r *RecordedRequest) { r.Headers["User-Agent"] = "sdk/2.0" },
+			wantEqual: false,
+		},
+		{
+			name:  "Unselected query param is ignored",
+			match: &config.MatchConfig{Path: true, QueryParams: []string{"alt"}},
+			modify: func(r *RecordedRequest) {
+				r.URL = "/v1/models/gemini:generateContent?alt=sse&key=xyz"
+			},
+			wantEqual: true,
+		},
+		{
+			name:  "Selected query param is compared",
+			match: &config.MatchConfig{Path: true, QueryParams: []string{"alt"}},
+			modify: func(r *RecordedRequest) {
+				r.URL = "/v1/models/gemini:generateContent?alt=json&key=abc"
+			},
+			wantEqual: false,
+		},
+		{
+			name:      "Body is compared when selected",
+			match:     &config.MatchConfig{Body: true},
+			modify:    func(r *RecordedRequest) { r.BodySegments = []any{map[string]any{"contents": "bye"}} },
+			wantEqual: false,
+		},
+		{
+			name:      "Server address is ignored by match config",
+			match:     &config.MatchConfig{Method: true, Path: true},
+			modify:    func(r *RecordedRequest) { r.ServerAddress = "other.example.com" },
+			wantEqual: true,
+		},
+		{
+			name:      "Previous request is always compared",
+			match:     &config.MatchConfig{Method: true},
+			modify:    func(r *RecordedRequest) { r.PreviousRequest = "other" },
+			wantEqual: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher, err := NewMatcher(&config.EndpointConfig{Match: tc.match})
+			require.NoError(t, err)
+
+			original := copyRequest(base)
+			modified := copyRequest(base)
+			tc.modify(&modified)
+
+			if tc.wantEqual {
+				require.Equal(t, matcher.Sum(&original), matcher.Sum(&modified))
+			} else {
+				require.NotEqual(t, matcher.Sum(&original), matcher.Sum(&modified))
+			}
+		})
+	}
+}
+
+func TestMatcher_SumDefaultsToComputeSum(t *testing.T) {
+	request := RecordedRequest{
+		Method:          "GET",
+		URL:             "/",
+		Request:         "GET / HTTP/1.1",
+		PreviousRequest: HeadSHA,
+	}
+	matcher, err := NewMatcher(&config.EndpointConfig{})
+	require.NoError(t, err)
+	require.Equal(t, request.ComputeSum(), matcher.Sum(&request))
+}
+
+func TestMatcher_IgnoreBodyFields(t *testing.T) {
+	recorded := RecordedRequest{
+		Method:          "POST",
+		URL:             "/v1/models/gemini:generateContent",
+		BodySegments:    []any{map[string]any{"requestId": "1", "generationConfig": map[string]any{"seed": 1.0, "topK": 3.0}}},
+		PreviousRequest: HeadSHA,
+	}
+	incoming := recorded
+	incoming.BodySegments = []any{map[string]any{"requestId": "2", "generationConfig": map[string]any{"seed": 2.0, "topK": 3.0}}}
+
+	for _, match := range []*config.MatchConfig{nil, {Method: true, Body: true}} {
+		matcher, err := NewMatcher(&config.EndpointConfig{
+			Match:            match,
+			IgnoreBodyFields: []string{"$.generationConfig.seed", "$..requestId"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, matcher.Sum(&recorded), matcher.Sum(&incoming))
+	}
+
+	// The raw values are kept in the request.
+	require.Equal(t, "1", recorded.BodySegments[0].(map[string]any)["requestId"])
+	require.Equal(t, 1.0, recorded.BodySegments[0].(map[string]any)["generationConfig"].(map[string]any)["seed"])
+
+	// Fields that are not ignored still count.
+	incoming.BodySegments = []any{map[string]any{"requestId": "2", "generationConfig": map[string]any{"seed": 2.0, "topK": 4.0}}}
+	matcher, err := NewMatcher(&config.EndpointConfig{IgnoreBodyFields: []string{"$.generationConfig.seed", "$..requestId"}})
+	require.NoError(t, err)
+	require.NotEqual(t, matcher.Sum(&recorded), matcher.Sum(&incoming))
+}
+
+func TestMatcher_ContentSum(t *testing.T) {
+	first := RecordedRequest{Method: "GET", URL: "/", PreviousRequest: HeadSHA}
+	second := RecordedRequest{Method: "GET", URL: "/", PreviousRequest: "other"}
+
+	for _, match := range []*config.MatchConfig{nil, {Method: true, Path: true}} {
+		matcher, err := NewMatcher(&config.EndpointConfig{Match: match})
+		require.NoError(t, err)
+		require.NotEqual(t, matcher.Sum(&first), matcher.Sum(&second))
+		require.Equal(t, matcher.ContentSum(&first), matcher.ContentSum(&second))
+	}
+}
+
+func TestMatcher_DiffRequests(t *testing.T) {
+	recorded := &RecordedRequest{
+		Method:          "POST",
+		URL:             "/v1/models/gemini:generateContent?alt=sse&key=abc",
+		Request:         "POST /v1/models/gemini:generateContent?alt=sse&key=abc HTTP/1.1",
+		Headers:         map[string]string{"Content-Type": "application/json", "User-Agent": "sdk/1.0"},
+		BodySegments:    []any{map[string]any{"contents": "hello", "seed": 1.0}},
+		PreviousRequest: HeadSHA,
+		ServerAddress:   "generativelanguage.googleapis.com",
+		Port:            443,
+		Protocol:        "https",
+	}
+	actual := &RecordedRequest{
+		Method:          "POST",
+		URL:             "/v1/models/gemini:generateContent?alt=json&key=xyz",
+		Request:         "POST /v1/models/gemini:generateContent?alt=json&key=xyz HTTP/2.0",
+		Headers:         map[string]string{"Content-Type": "application/json", "User-Agent": "sdk/2.0"},
+		BodySegments:    []any{map[string]any{"contents": "bye", "seed": 2.0}},
+		PreviousRequest: HeadSHA,
+		ServerAddress:   "localhost",
+		Port:            8080,
+		Protocol:        "http",
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      *config.EndpointConfig
+		expected []FieldDiff
+	}{
+		{
+			name: "Default matcher compares the whole request",
+			cfg:  &config.EndpointConfig{},
+			expected: []FieldDiff{
+				{Field: "url", Recorded: "/v1/models/gemini:generateContent?alt=sse&key=abc", Actual: "/v1/models/gemini:generateContent?alt=json&key=xyz"},
+				{Field: "request", Recorded: "POST /v1/models/gemini:generateContent?alt=sse&key=abc HTTP/1.1", Actual: "POST /v1/models/gemini:generateContent?alt=json&key=xyz HTTP/2.0"},
+				{Field: "headers.User-Agent", Recorded: "sdk/1.0", Actual: "sdk/2.0"},
+				{Field: "bodySegments[0].contents", Recorded: "hello", Actual: "bye"},
+				{Field: "bodySegments[0].seed", Recorded: 1.0, Actual: 2.0},
+				{Field: "serverAddress", Recorded: "generativelanguage.googleapis.com", Actual: "localhost"},
+				{Field: "port", Recorded: int64(443), Actual: int64(8080)},
+				{Field: "protocol", Recorded: "https", Actual: "http"},
+			},
+		},
+		{
+			name: "Only the selected parts are compared",
+			cfg: &config.EndpointConfig{
+				Match:            &config.MatchConfig{Method: true, Path: true, QueryParams: []string{"alt"}, Body: true},
+				IgnoreBodyFields: []string{"$.seed"},
+			},
+			expected: []FieldDiff{
+				{Field: "url", Recorded: "/v1/models/gemini:generateContent?alt=sse", Actual: "/v1/models/gemini:generateContent?alt=json"},
+				{Field: "bodySegments[0].contents", Recorded: "hello", Actual: "bye"},
+			},
+		},
+		{
+			name:     "Unselected body is not compared",
+			cfg:      &config.EndpointConfig{Match: &config.MatchConfig{Method: true, Path: true}},
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher, err := NewMatcher(tc.cfg)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, matcher.DiffRequests(recorded, actual))
+		})
+	}
+}
+
+func TestMatcher_RecordingFileName(t *testing.T) {
+	recorded := RecordedRequest{
+		Method:          "POST",
+		URL:             "/v1/models/gemini:generateContent",
+		Headers:         map[string]string{"User-Agent": "sdk/1.0"},
+		BodySegments:    []any{map[string]any{"contents": "hello", "seed": 1.0}},
+		PreviousRequest: HeadSHA,
+	}
+	matcher, err := NewMatcher(&config.EndpointConfig{
+		Match:            &config.MatchConfig{Method: true, Path: true, Body: true},
+		IgnoreBodyFields: []string{"$.seed"},
+	})
+	require.NoError(t, err)
+	fileName, err := matcher.RecordingFileName(&recorded)
+	require.NoError(t, err)
+	require.Equal(t, matcher.Sum(&recorded), fileName)
+
+	testCases := []struct {
+		name      string
+		modify    func(r *RecordedRequest)
+		wantEqual bool
+	}{
+		{
+			name:      "Unmatched header is ignored",
+			modify:    func(r *RecordedRequest) { r.Headers["User-Agent"] = "sdk/2.0" },
+			wantEqual: true,
+		},
+		{
+			name:      "Ignored body field is ignored",
+			modify:    func(r *RecordedRequest) { r.BodySegments = []any{map[string]any{"contents": "hello", "seed": 2.0}} },
+			wantEqual: true,
+		},
+		{
+			name:      "Position in the chain is ignored",
+			modify:    func(r *RecordedRequest) { r.PreviousRequest = "other" },
+			wantEqual: true,
+		},
+		{
+			name:      "Matched body is compared",
+			modify:    func(r *RecordedRequest) { r.BodySegments = []any{map[string]any{"contents": "bye", "seed": 1.0}} },
+			wantEqual: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			incoming := copyRequest(recorded)
+			tc.modify(&incoming)
+			actual, err := matcher.RecordingFileName(&incoming)
+			require.NoError(t, err)
+			if tc.wantEqual {
+				require.Equal(t, fileName, actual)
+			} else {
+				require.NotEqual(t, fileName, actual)
+			}
+		})
+	}
+
+	t.Run("Test name", func(t *testing.T) {
+		incoming := copyRequest(recorded)
+		incoming.Headers["Test-Name"] = "suite test"
+		actual, err := matcher.RecordingFileName(&incoming)
+		require.NoError(t, err)
+		require.Equal(t, "suite_test", actual)
+
+		incoming.Headers["Test-Name"] = "../test"
+		_, err = matcher.RecordingFileName(&incoming)
+		require.Error(t, err)
+	})
+}
+
+func TestNewMatcher_InvalidIgnoreBodyFields(t *testing.T) {
+	_, err := NewMatcher(&config.EndpointConfig{IgnoreBodyFields: []string{"generationConfig.seed"}})
+	require.Error(t, err)
+}
+
+func copyRequest(r RecordedRequest) RecordedRequest {
+	headers := make(map[string]string, len(r.Headers))
+	for k, v := range r.Headers {
+		headers[k] = v
+	}
+	r.Headers = headers
+	return r
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/google/test-server/internal/redact"
+)
+
+// SSEEvent is a single Server-Sent Event of a text/event-stream response.
+type SSEEvent struct {
+	Comments []string `json:"comments,omitempty"`
+	Event    string   `json:"event,omitempty"`
+	ID       string   `json:"id,omitempty"`
+	Retry    string   `json:"retry,omitempty"`
+	// Data holds the lines of the event's data fields.
+	Data []string `json:"data,omitempty"`
+}
+
+// IsEventStream reports whether the content type is text/event-stream.
+func IsEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// ParseSSEEvents parses a text/event-stream body into its events.
+func ParseSSEEvents(body []byte) ([]*SSEEvent, error) {
+	events, _, err := parseSSEEvents(body)
+	return events, err
+}
+
+// parseSSEEvents parses a text/event-stream body into its events and returns,
+// for each event, the offset in body where the event ends.
+func parseSSEEvents(body []byte) ([]*SSEEvent, []int, error) {
+	var events []*SSEEvent
+	var ends []int
+	var event *SSEEvent
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	buf := make([]byte, ReadBufferSize)
+	scanner.Buffer(buf, ReadBufferSize)
+	offset := 0
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		offset += advance
+		return advance, token, err
+	})
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// A blank line dispatches the event.
+			if event != nil {
+				events = append(events, event)
+				ends = append(ends, offset)
+				event = nil
+			}
+			continue
+		}
+		if event == nil {
+			event = &SSEEvent{}
+		}
+
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+		switch field {
+		case "":
+			event.Comments = append(event.Comments, value)
+		case "event":
+			event.Event = value
+		case "id":
+			event.ID = value
+		case "retry":
+			event.Retry = value
+		case "data":
+			event.Data = append(event.Data, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if event != nil {
+		events = append(events, event)
+		ends = append(ends, len(body))
+	}
+	return events, ends, nil
+}
+
+// Bytes serializes the event in the text/event-stream format, including the
+// blank line that terminates it.
+func (e *SSEEvent) Bytes() []byte {
+	var buf bytes.Buffer
+	writeField := func(field, value string) {
+		buf.WriteString(field)
+		buf.WriteString(": ")
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+	}
+	for _, comment := range e.Comments {
+		writeField("", comment)
+	}
+	if e.Event != "" {
+		writeField("event", e.Event)
+	}
+	if e.ID != "" {
+		writeField("id", e.ID)
+	}
+	if e.Retry != "" {
+		writeField("retry", e.Retry)
+	}
+	for _, data := range e.Data {
+		writeField("data", data)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// Redact returns a copy of the event with the secrets redacted, and the
+// redacted fields of data lines holding a JSON document.
+func (e *SSEEvent) Redact(redactor *redact.Redact) *SSEEvent {
+	redacted := &SSEEvent{
+		Event: redactor.String(e.Event),
+		ID:    redactor.String(e.ID),
+		Retry: e.Retry,
+	}
+	for _, comment := range e.Comments {
+		redacted.Comments = append(redacted.Comments, redactor.String(comment))
+	}
+	for _, data := range e.Data {
+		redacted.Data = append(redacted.Data, string(redactor.JSON([]byte(data))))
+	}
+	return redacted
+}
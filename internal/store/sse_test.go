@@ -0,0 +1,95 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSSEEvents(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected []*SSEEvent
+	}{
+		{
+			name:  "Data only events",
+			input: "data: {\"a\": 1}\n\ndata: {\"b\": 2}\n\n",
+			expected: []*SSEEvent{
+				{Data: []string{`{"a": 1}`}},
+				{Data: []string{`{"b": 2}`}},
+			},
+		},
+		{
+			name:  "All fields",
+			input: ": keep-alive\nevent: delta\nid: 42\nretry: 3000\ndata: line 1\ndata: line 2\n\n",
+			expected: []*SSEEvent{
+				{Comments: []string{"keep-alive"}, Event: "delta", ID: "42", Retry: "3000", Data: []string{"line 1", "line 2"}},
+			},
+		},
+		{
+			name:  "CRLF line endings and missing space",
+			input: "event:done\r\ndata:\r\n\r\n",
+			expected: []*SSEEvent{
+				{Event: "done", Data: []string{""}},
+			},
+		},
+		{
+			name:  "Unterminated last event",
+			input: "data: first\n\ndata: last",
+			expected: []*SSEEvent{
+				{Data: []string{"first"}},
+				{Data: []string{"last"}},
+			},
+		},
+		{
+			name:     "Empty stream",
+			input:    "",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := ParseSSEEvents([]byte(tc.input))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, events)
+		})
+	}
+}
+
+func TestSSEEvent_Bytes(t *testing.T) {
+	input := ": keep-alive\nevent: delta\nid: 42\nretry: 3000\ndata: line 1\ndata: line 2\n\ndata: {\"b\": 2}\n\n"
+	events, err := ParseSSEEvents([]byte(input))
+	require.NoError(t, err)
+
+	var output bytes.Buffer
+	for _, event := range events {
+		output.Write(event.Bytes())
+	}
+	require.Equal(t, input, output.String())
+}
+
+func TestIsEventStream(t *testing.T) {
+	require.True(t, IsEventStream("text/event-stream"))
+	require.True(t, IsEventStream("text/event-stream; charset=utf-8"))
+	require.False(t, IsEventStream("application/json"))
+	require.False(t, IsEventStream(""))
+}
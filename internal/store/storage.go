@@ -0,0 +1,374 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/tarfs"
+	"github.com/spf13/afero/zipfs"
+)
+
+// Storage loads and saves the recordings of tests. Recordings are named after
+// the recording file name of their requests.
+type Storage interface {
+	// StatRecordFile returns information about the stored RecordFile, which
+	// changes whenever the RecordFile is saved or an interaction is appended
+	// to it.
+	StatRecordFile(name string) (os.FileInfo, error)
+	// LoadRecordFile loads the saved RecordFile or, when it was never saved,
+	// the interactions of its journal.
+	LoadRecordFile(name string) (*RecordFile, error)
+	// SaveRecordFile replaces the stored RecordFile and its journal atomically.
+	SaveRecordFile(name string, recordFile *RecordFile) error
+	// StartJournal replaces the stored RecordFile with a journal holding the
+	// interactions, to which AppendInteraction appends.
+	StartJournal(name string, interactions []*RecordInteraction) error
+	// AppendInteraction appends the interaction to the journal started by
+	// StartJournal. The interaction is stored when it returns.
+	AppendInteraction(name string, interaction *RecordInteraction) error
+	// LoadWebsocketLog loads the websocket log of the endpoint, as returned by
+	// EndpointName, or the log shared by all endpoints of older recordings.
+	LoadWebsocketLog(name, endpoint string) ([]byte, error)
+	// CreateWebsocketLog creates or truncates the websocket log of the
+	// endpoint for writing.
+	CreateWebsocketLog(name, endpoint string) (io.WriteCloser, error)
+}
+
+// FsStorage stores recordings as files in an afero file system:
+// <name>.json or <name>.json.gz for RecordFiles, <name>.jsonl for journals
+// holding one interaction per line and <name>.<endpoint>.websocket.log for
+// the websocket log of each endpoint. Older recordings have a single
+// <name>.websocket.log.
+//
+// A RecordFile takes precedence over its journal. A journal replaces its
+// RecordFile only once it was fully written, and the RecordFile replaces its
+// journal when it is saved, so the recording can be loaded whenever the
+// process stops.
+type FsStorage struct {
+	fs afero.Fs
+	// Compress makes SaveRecordFile write gzip compressed <name>.json.gz files.
+	// Both forms are always loaded.
+	Compress bool
+	// BlobThreshold is the size above which SaveRecordFile stores the body of
+	// a request or response in a blob. Zero disables blobs. Blobs are always
+	// loaded.
+	BlobThreshold int
+}
+
+// NewFsStorage creates a Storage keeping the recordings at the root of fs.
+func NewFsStorage(fs afero.Fs) *FsStorage {
+	return &FsStorage{fs: fs}
+}
+
+// NewDirStorage creates a Storage keeping the recordings in a directory.
+func NewDirStorage(dir string) *FsStorage {
+	return NewFsStorage(afero.NewBasePathFs(afero.NewOsFs(), dir))
+}
+
+// OpenStorage opens the recordings at path. A .zip, .tar, .tar.gz or .tgz
+// path is opened as a read-only archive, any other path as a directory.
+func OpenStorage(path string) (*FsStorage, error) {
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		reader, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zip archive %s: %w", path, err)
+		}
+		return NewFsStorage(zipfs.New(&reader.Reader)), nil
+	case strings.HasSuffix(path, ".tar"), strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open tar archive %s: %w", path, err)
+		}
+		defer file.Close()
+		var reader io.Reader = file
+		if !strings.HasSuffix(path, ".tar") {
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open tar archive %s: %w", path, err)
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+		// tarfs reads the whole archive into memory.
+		return NewFsStorage(tarfs.New(tar.NewReader(reader))), nil
+	default:
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("recording directory does not exist: %s", path)
+		}
+		return NewDirStorage(path), nil
+	}
+}
+
+func recordFilePath(name string) string {
+	return "/" + name + ".json"
+}
+
+func compressedRecordFilePath(name string) string {
+	return recordFilePath(name) + ".gz"
+}
+
+func journalPath(name string) string {
+	return "/" + name + ".jsonl"
+}
+
+func websocketLogPath(name string) string {
+	return "/" + name + ".websocket.log"
+}
+
+// endpointWebsocketLogPath returns the path of the websocket log of the
+// endpoint, with the characters of the endpoint that are not valid in file
+// names, such as the colon before its port, replaced with underscores.
+func endpointWebsocketLogPath(name, endpoint string) string {
+	endpoint = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, endpoint)
+	return "/" + name + "." + endpoint + ".websocket.log"
+}
+
+func (s *FsStorage) StatRecordFile(name string) (os.FileInfo, error) {
+	info, err := s.fs.Stat(recordFilePath(name))
+	if !errors.Is(err, os.ErrNotExist) {
+		return info, err
+	}
+	for _, filePath := range []string{compressedRecordFilePath(name), journalPath(name)} {
+		if info, err := s.fs.Stat(filePath); !errors.Is(err, os.ErrNotExist) {
+			return info, err
+		}
+	}
+	// Report the missing file under the name of the RecordFile.
+	return nil, err
+}
+
+func (s *FsStorage) LoadRecordFile(name string) (*RecordFile, error) {
+	data, err := afero.ReadFile(s.fs, recordFilePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = s.readCompressed(compressedRecordFilePath(name))
+	}
+	var recordFile RecordFile
+	if errors.Is(err, os.ErrNotExist) {
+		var journalErr error
+		recordFile.RecordID = name
+		recordFile.Interactions, journalErr = s.readJournal(name)
+		if errors.Is(journalErr, os.ErrNotExist) {
+			// Report the missing file under the name of the RecordFile.
+			return nil, &os.PathError{Op: "open", Path: recordFilePath(name), Err: os.ErrNotExist}
+		}
+		if journalErr != nil {
+			return nil, journalErr
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &recordFile); err != nil {
+		return nil, fmt.Errorf("unable to deserialize data to RecordFile: %w", err)
+	}
+	if err := s.internalizeBlobs(&recordFile); err != nil {
+		return nil, err
+	}
+	return &recordFile, nil
+}
+
+func (s *FsStorage) readCompressed(filePath string) ([]byte, error) {
+	file, err := s.fs.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", filePath, err)
+	}
+	defer gzipReader.Close()
+	return io.ReadAll(gzipReader)
+}
+
+// SaveRecordFile writes the RecordFile in the form selected by Compress and
+// removes the file of the other form, if any.
+func (s *FsStorage) SaveRecordFile(name string, recordFile *RecordFile) error {
+	if s.BlobThreshold > 0 {
+		var err error
+		if recordFile, err = s.externalizeBlobs(recordFile); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(recordFile, "", "  ")
+	if err != nil {
+		return err
+	}
+	filePath, stalePath := recordFilePath(name), compressedRecordFilePath(name)
+	if s.Compress {
+		var compressed bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressed)
+		if _, err := gzipWriter.Write(data); err != nil {
+			return err
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+		filePath, stalePath = stalePath, filePath
+	}
+	if err := s.writeFileAtomic(filePath, data); err != nil {
+		return err
+	}
+	return s.removeFiles(stalePath, journalPath(name))
+}
+
+// StartJournal writes the journal, then removes the RecordFile, which would
+// otherwise take precedence.
+func (s *FsStorage) StartJournal(name string, interactions []*RecordInteraction) error {
+	var data []byte
+	for _, interaction := range interactions {
+		line, err := s.journalLine(interaction)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+	if err := s.writeFileAtomic(journalPath(name), data); err != nil {
+		return err
+	}
+	return s.removeFiles(recordFilePath(name), compressedRecordFilePath(name))
+}
+
+// AppendInteraction writes the interaction as a single line at the end of the
+// journal, so that recording stays linear in the number of interactions.
+func (s *FsStorage) AppendInteraction(name string, interaction *RecordInteraction) error {
+	line, err := s.journalLine(interaction)
+	if err != nil {
+		return err
+	}
+	file, err := s.fs.OpenFile(journalPath(name), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// journalLine returns the line of the journal holding the interaction.
+func (s *FsStorage) journalLine(interaction *RecordInteraction) ([]byte, error) {
+	if s.BlobThreshold > 0 {
+		external, err := s.externalizeBlobs(&RecordFile{Interactions: []*RecordInteraction{interaction}})
+		if err != nil {
+			return nil, err
+		}
+		interaction = external.Interactions[0]
+	}
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// readJournal reads the interactions of the journal. A last line without a
+// newline was cut short while it was appended, and is skipped.
+func (s *FsStorage) readJournal(name string) ([]*RecordInteraction, error) {
+	data, err := afero.ReadFile(s.fs, journalPath(name))
+	if err != nil {
+		return nil, err
+	}
+	interactions := []*RecordInteraction{}
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			break
+		}
+		var interaction RecordInteraction
+		if err := json.Unmarshal(line, &interaction); err != nil {
+			return nil, fmt.Errorf("unable to deserialize interaction %d of %s: %w", len(interactions), journalPath(name), err)
+		}
+		interactions = append(interactions, &interaction)
+		data = rest
+	}
+	return interactions, nil
+}
+
+// removeFiles removes the files that exist.
+func (s *FsStorage) removeFiles(filePaths ...string) error {
+	for _, filePath := range filePaths {
+		if err := s.fs.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filePath and renames
+// it to filePath, so readers see either the previous or the new content.
+func (s *FsStorage) writeFileAtomic(filePath string, data []byte) error {
+	dir := path.Dir(filePath)
+	if err := s.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := afero.TempFile(s.fs, dir, path.Base(filePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer s.fs.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := s.fs.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return s.fs.Rename(tmp.Name(), filePath)
+}
+
+func (s *FsStorage) LoadWebsocketLog(name, endpoint string) ([]byte, error) {
+	data, err := afero.ReadFile(s.fs, endpointWebsocketLogPath(name, endpoint))
+	if !errors.Is(err, os.ErrNotExist) {
+		return data, err
+	}
+	return afero.ReadFile(s.fs, websocketLogPath(name))
+}
+
+func (s *FsStorage) CreateWebsocketLog(name, endpoint string) (io.WriteCloser, error) {
+	filePath := endpointWebsocketLogPath(name, endpoint)
+	if err := s.fs.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	return s.fs.Create(filePath)
+}
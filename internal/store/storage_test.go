@@ -0,0 +1,280 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsStorage(t *testing.T) {
+	storage := NewFsStorage(afero.NewMemMapFs())
+	recordFile := &RecordFile{RecordID: "suite/test", Interactions: []*RecordInteraction{{SHASum: "abc"}}}
+	require.NoError(t, storage.SaveRecordFile("suite/test", recordFile))
+
+	loaded, err := storage.LoadRecordFile("suite/test")
+	require.NoError(t, err)
+	require.Equal(t, recordFile, loaded)
+	info, err := storage.StatRecordFile("suite/test")
+	require.NoError(t, err)
+	require.Positive(t, info.Size())
+
+	for endpoint, content := range map[string]string{"a.example.com:443": ">5 ping\n", "b.example.com:443": ">5 pong\n"} {
+		w, err := storage.CreateWebsocketLog("suite/test", endpoint)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, content)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	log, err := storage.LoadWebsocketLog("suite/test", "a.example.com:443")
+	require.NoError(t, err)
+	require.Equal(t, ">5 ping\n", string(log))
+	log, err = storage.LoadWebsocketLog("suite/test", "b.example.com:443")
+	require.NoError(t, err)
+	require.Equal(t, ">5 pong\n", string(log))
+	_, err = storage.fs.Stat("/suite/test.a.example.com_443.websocket.log")
+	require.NoError(t, err)
+
+	_, err = storage.LoadRecordFile("missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorContains(t, err, "/missing.json:")
+	_, err = storage.StatRecordFile("missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorContains(t, err, "/missing.json:")
+}
+
+func TestFsStorage_Compress(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := NewFsStorage(fs)
+	storage.Compress = true
+	recordFile := &RecordFile{RecordID: "test", Interactions: []*RecordInteraction{{SHASum: "abc"}}}
+	require.NoError(t, storage.SaveRecordFile("test", recordFile))
+
+	f, err := fs.Open("/test.json.gz")
+	require.NoError(t, err)
+	gzipReader, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Contains(t, string(data), `"recordID": "test"`)
+
+	// Both forms are loaded regardless of Compress.
+	loaded, err := NewFsStorage(fs).LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Equal(t, recordFile, loaded)
+	_, err = NewFsStorage(fs).StatRecordFile("test")
+	require.NoError(t, err)
+
+	// Saving the other form replaces the file.
+	require.NoError(t, NewFsStorage(fs).SaveRecordFile("test", recordFile))
+	_, err = fs.Stat("/test.json.gz")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	loaded, err = storage.LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Equal(t, recordFile, loaded)
+}
+
+func TestFsStorage_Journal(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := NewFsStorage(fs)
+	require.NoError(t, storage.SaveRecordFile("test", &RecordFile{RecordID: "test", Interactions: []*RecordInteraction{{SHASum: "old"}}}))
+
+	// The journal replaces the saved RecordFile.
+	require.NoError(t, storage.StartJournal("test", []*RecordInteraction{{SHASum: "a"}}))
+	_, err := fs.Stat("/test.json")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	info, err := storage.StatRecordFile("test")
+	require.NoError(t, err)
+	size := info.Size()
+	require.NoError(t, storage.AppendInteraction("test", &RecordInteraction{SHASum: "b"}))
+	info, err = storage.StatRecordFile("test")
+	require.NoError(t, err)
+	require.Greater(t, info.Size(), size)
+
+	recordFile := &RecordFile{RecordID: "test", Interactions: []*RecordInteraction{{SHASum: "a"}, {SHASum: "b"}}}
+	loaded, err := storage.LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Equal(t, recordFile, loaded)
+
+	// A line cut short by a crash while it was appended is skipped.
+	f, err := fs.OpenFile("/test.jsonl", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"shaSum": "c`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	loaded, err = storage.LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Equal(t, recordFile, loaded)
+
+	// Saving the RecordFile removes the journal.
+	require.NoError(t, storage.SaveRecordFile("test", recordFile))
+	_, err = fs.Stat("/test.jsonl")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	loaded, err = storage.LoadRecordFile("test")
+	require.NoError(t, err)
+	require.Equal(t, recordFile, loaded)
+}
+
+func TestFsStorage_Blobs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := NewFsStorage(fs)
+	storage.BlobThreshold = 100
+	largeText := strings.Repeat("large response ", 20)
+	newRecordFile := func(name string) *RecordFile {
+		return &RecordFile{RecordID: name, Interactions: []*RecordInteraction{{
+			Request:  &RecordedRequest{Method: "POST", BodySegments: []any{map[string]any{"prompt": "small"}}},
+			SHASum:   "abc",
+			Response: &RecordedResponse{StatusCode: 200, BodySegments: []map[string]any{{"text": largeText}}},
+		}}}
+	}
+
+	for _, name := range []string{"first", "second"} {
+		recordFile := newRecordFile(name)
+		require.NoError(t, storage.SaveRecordFile(name, recordFile))
+		// The recording being saved is not modified.
+		require.Equal(t, newRecordFile(name), recordFile)
+
+		data, err := afero.ReadFile(fs, "/"+name+".json")
+		require.NoError(t, err)
+		require.NotContains(t, string(data), largeText)
+		require.Contains(t, string(data), `"bodyBlob"`)
+		require.Contains(t, string(data), `"small"`)
+
+		loaded, err := storage.LoadRecordFile(name)
+		require.NoError(t, err)
+		require.Equal(t, recordFile, loaded)
+	}
+
+	// Identical bodies are stored once.
+	blobs, err := afero.ReadDir(fs, "/blobs")
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+
+	// Blobs are loaded whatever the threshold.
+	loaded, err := NewFsStorage(fs).LoadRecordFile("first")
+	require.NoError(t, err)
+	require.Equal(t, newRecordFile("first"), loaded)
+}
+
+func TestOpenStorage(t *testing.T) {
+	files := map[string]string{
+		"test.json":          `{"recordID": "test", "interactions": [{"shaSum": "abc"}]}`,
+		"test.websocket.log": ">5 ping\n",
+	}
+
+	writeZip := func(t *testing.T, path string) {
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		defer f.Close()
+		w := zip.NewWriter(f)
+		for name, content := range files {
+			fw, err := w.Create(name)
+			require.NoError(t, err)
+			_, err = io.WriteString(fw, content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+	}
+	writeTar := func(t *testing.T, w io.Writer) {
+		tw := tar.NewWriter(w)
+		for name, content := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}))
+			_, err := io.WriteString(tw, content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+	}
+
+	testCases := []struct {
+		name  string
+		path  string
+		write func(t *testing.T, path string)
+	}{
+		{
+			name: "Directory",
+			path: "recordings",
+			write: func(t *testing.T, path string) {
+				require.NoError(t, os.Mkdir(path, 0755))
+				for name, content := range files {
+					require.NoError(t, os.WriteFile(filepath.Join(path, name), []byte(content), 0644))
+				}
+			},
+		},
+		{
+			name:  "Zip archive",
+			path:  "recordings.zip",
+			write: writeZip,
+		},
+		{
+			name: "Tar archive",
+			path: "recordings.tar",
+			write: func(t *testing.T, path string) {
+				f, err := os.Create(path)
+				require.NoError(t, err)
+				defer f.Close()
+				writeTar(t, f)
+			},
+		},
+		{
+			name: "Gzipped tar archive",
+			path: "recordings.tar.gz",
+			write: func(t *testing.T, path string) {
+				f, err := os.Create(path)
+				require.NoError(t, err)
+				defer f.Close()
+				gw := gzip.NewWriter(f)
+				writeTar(t, gw)
+				require.NoError(t, gw.Close())
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.path)
+			tc.write(t, path)
+
+			storage, err := OpenStorage(path)
+			require.NoError(t, err)
+			recordFile, err := storage.LoadRecordFile("test")
+			require.NoError(t, err)
+			require.Equal(t, "test", recordFile.RecordID)
+			require.Equal(t, "abc", recordFile.Interactions[0].SHASum)
+			_, err = storage.StatRecordFile("test")
+			require.NoError(t, err)
+			// Older recordings have a single log for all endpoints.
+			log, err := storage.LoadWebsocketLog("test", "example.com:443")
+			require.NoError(t, err)
+			require.Equal(t, ">5 ping\n", string(log))
+		})
+	}
+
+	t.Run("Missing directory", func(t *testing.T) {
+		_, err := OpenStorage(filepath.Join(t.TempDir(), "missing"))
+		require.Error(t, err)
+	})
+}
@@ -17,16 +17,16 @@ limitations under the License.
 package store
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"math/big"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/google/test-server/internal/config"
@@ -41,6 +41,9 @@ type RecordInteraction struct {
 	Request  *RecordedRequest  `json:"request,omitempty"`
 	SHASum   string            `json:"shaSum,omitempty"`
 	Response *RecordedResponse `json:"response,omitempty"`
+	// Endpoint is the name of the endpoint that served the interaction, as
+	// returned by EndpointName. It is empty in older recordings.
+	Endpoint string `json:"endpoint,omitempty"`
 }
 
 // Represents a recorded session.
@@ -50,11 +53,20 @@ type RecordFile struct {
 }
 
 type RecordedRequest struct {
-	Method       string            `json:"method,omitempty"`
-	URL          string            `json:"url,omitempty"`
-	Request      string            `json:"request,omitempty"`
-	Headers      map[string]string `json:"headers,omitempty"`
-	BodySegments []map[string]any  `json:"bodySegments,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Request string            `json:"request,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// BodySegments holds the decoded JSON body: an object, array or scalar.
+	// Unlike response bodies, JSON request bodies are not stored verbatim, as
+	// the sums of recorded requests are computed from their decoded form.
+	// Integers that float64 cannot hold exactly are kept as json.Number.
+	BodySegments []any `json:"bodySegments,omitempty"`
+	// Body holds the request body when it is not JSON.
+	Body *Body `json:"body,omitempty"`
+	// BodyBlob references the blob holding the body when it is too large to
+	// be stored in the recording. It is only set in stored recordings.
+	BodyBlob string `json:"bodyBlob,omitempty"`
 	// The sha256 sum of the previous request in the chain.
 	PreviousRequest string `json:"previousRequest,omitempty"`
 	ServerAddress   string `json:"serverAddress,omitempty"`
@@ -63,16 +75,33 @@ type RecordedRequest struct {
 }
 
 type RecordedResponse struct {
-	StatusCode          int32             `json:"statusCode,omitempty"`
-	Headers             map[string]string `json:"headers,omitempty"`
-	BodySegments        []map[string]any  `json:"bodySegments,omitempty"`
-	SDKResponseSegments []map[string]any  `json:"sdkResponseSegments,omitempty"`
+	StatusCode int32  `json:"statusCode,omitempty"`
+	Headers    Header `json:"headers,omitempty"`
+	// BodySegments holds the decoded JSON body in recordings made before
+	// bodies were stored verbatim.
+	BodySegments        []map[string]any `json:"bodySegments,omitempty"`
+	SDKResponseSegments []map[string]any `json:"sdkResponseSegments,omitempty"`
+	// Body holds the response body exactly as sent by the server, unless it is
+	// an event stream.
+	Body *Body `json:"body,omitempty"`
+	// Events holds the events of a text/event-stream response.
+	Events []*SSEEvent `json:"events,omitempty"`
+	// BodyBlob references the blob holding the body when it is too large to
+	// be stored in the recording. It is only set in stored recordings.
+	BodyBlob string  `json:"bodyBlob,omitempty"`
+	Timing   *Timing `json:"timing,omitempty"`
+}
+
+// EndpointName returns the name identifying an endpoint in recordings, its
+// target host and port.
+func EndpointName(cfg *config.EndpointConfig) string {
+	return fmt.Sprintf("%s:%d", cfg.TargetHost, cfg.TargetPort)
 }
 
 // NewRecordedRequest creates a RecordedRequest from an http.Request.
 func NewRecordedRequest(req *http.Request, previousRequest string, cfg config.EndpointConfig) (*RecordedRequest, error) {
 	// Read the body.
-	body, err := readBody(req)
+	bodySegment, body, err := readBody(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body: %w", err)
 	}
@@ -82,6 +111,9 @@ func NewRecordedRequest(req *http.Request, previousRequest string, cfg config.En
 
 	// Create a copy of the headers.
 	header := req.Header.Clone()
+	if contentType, _ := normalizeMultipart(header.Get("Content-Type"), nil); contentType != header.Get("Content-Type") {
+		header.Set("Content-Type", contentType)
+	}
 
 	// Create the RecordedRequest.
 	recordedRequest := &RecordedRequest{
@@ -89,36 +121,113 @@ func NewRecordedRequest(req *http.Request, previousRequest string, cfg config.En
 		URL:             req.URL.String(),
 		Request:         request,
 		Headers:         GetHeadersMap(&header),
-		BodySegments:    []map[string]any{body},
 		PreviousRequest: previousRequest,
 		ServerAddress:   cfg.TargetHost,
 		Port:            cfg.TargetPort,
 		Protocol:        cfg.TargetType,
 	}
+	if body != nil {
+		recordedRequest.Body = body
+	} else {
+		recordedRequest.BodySegments = []any{bodySegment}
+	}
 
 	return recordedRequest, nil
 }
 
-func readBody(req *http.Request) (map[string]any, error) {
+// readBody reads the request body. A JSON value is returned decoded, any
+// other payload as a Body typed by the request's Content-Type.
+func readBody(req *http.Request) (any, *Body, error) {
 	if req.Body == nil {
-		return map[string]any{}, nil
+		return map[string]any{}, nil, nil
 	}
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	var resultMap map[string]any
+	// Restore the request body for further use.
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
 	if string(body) == "" {
-		return resultMap, nil
+		return nil, nil, nil
 	}
-	err = json.Unmarshal(body, &resultMap)
+	result, err := decodeJSONValue(body)
 	if err != nil {
-		log.Fatalf("Error unmarshaling JSON: %v", err)
+		return nil, NewBody(normalizeMultipart(req.Header.Get("Content-Type"), body)), nil
+	}
+	return result, nil, nil
+}
+
+// decodeJSONValue decodes a JSON request body, keeping integers that float64
+// cannot hold exactly as json.Number. The sums of requests then tell such
+// integers apart, while every other number keeps the float64 form that the
+// sums of existing recordings were computed from.
+func decodeJSONValue(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
 		return nil, err
 	}
-	// Restore the request body for further use.
-	req.Body = io.NopCloser(bytes.NewBuffer(body))
-	return resultMap, nil
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return exactNumbers(value), nil
+}
+
+// exactNumbers replaces the json.Numbers of a decoded JSON value with float64,
+// except the integers that float64 cannot hold exactly.
+func exactNumbers(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, element := range v {
+			v[key] = exactNumbers(element)
+		}
+	case []any:
+		for i, element := range v {
+			v[i] = exactNumbers(element)
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v
+		}
+		if strings.ContainsAny(string(v), ".eE") {
+			return f
+		}
+		integer, ok := new(big.Int).SetString(string(v), 10)
+		if !ok {
+			return f
+		}
+		if exact, accuracy := new(big.Float).SetFloat64(f).Int(nil); accuracy != big.Exact || exact.Cmp(integer) != 0 {
+			return v
+		}
+		return f
+	}
+	return value
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The body segments are decoded
+// like the body of an incoming request, so that their sums are the same.
+func (r *RecordedRequest) UnmarshalJSON(data []byte) error {
+	type recordedRequest RecordedRequest
+	var decoded struct {
+		*recordedRequest
+		BodySegments []json.RawMessage `json:"bodySegments,omitempty"`
+	}
+	decoded.recordedRequest = (*recordedRequest)(r)
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	r.BodySegments = nil
+	for _, segment := range decoded.BodySegments {
+		value, err := decodeJSONValue(segment)
+		if err != nil {
+			return err
+		}
+		r.BodySegments = append(r.BodySegments, value)
+	}
+	return nil
 }
 
 // ComputeSum computes the SHA256 sum of a RecordedRequest.
@@ -163,66 +272,117 @@ func (r *RecordedRequest) RedactHeaders(headers []string) {
 	}
 }
 
-func NewRecordedResponse(resp *http.Response, redactor *redact.Redact, body []byte) (*RecordedResponse, error) {
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+// RedactQueryParams replaces the values of the query parameters listed in
+// params with their placeholder and removes the parameters listed in remove,
+// both in the URL and in the request line. The other parameters are kept as
+// they are, in their order.
+func (r *RecordedRequest) RedactQueryParams(params, remove []string, redactor *redact.Redact) {
+	if len(params) == 0 && len(remove) == 0 {
+		return
+	}
+	path, rawQuery, found := strings.Cut(r.URL, "?")
+	if !found {
+		return
+	}
+	changed := false
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		rawName, rawValue, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(rawName)
 		if err != nil {
-			return nil, err
+			name = rawName
 		}
-		defer gzipReader.Close()
-
-		// Read the uncompressed body.
-		uncompressedBody := new(bytes.Buffer)
-		_, err = uncompressedBody.ReadFrom(gzipReader)
-		if err != nil {
-			return nil, err
+		switch {
+		case slices.Contains(remove, name):
+			changed = true
+			continue
+		case slices.Contains(params, name):
+			value, err := url.QueryUnescape(rawValue)
+			if err != nil {
+				value = rawValue
+			}
+			param = rawName + "=" + url.QueryEscape(redactor.Placeholder(value))
+			changed = true
 		}
-		body = uncompressedBody.Bytes()
-
+		kept = append(kept, param)
 	}
+	if !changed {
+		return
+	}
+	redactedURL := path
+	if len(kept) > 0 {
+		redactedURL += "?" + strings.Join(kept, "&")
+	}
+	r.Request = strings.Replace(r.Request, r.URL, redactedURL, 1)
+	r.URL = redactedURL
+}
 
-	var bodySegments []map[string]any
-	var bodySegment map[string]any
-	err := json.Unmarshal(body, &bodySegment)
-	if err != nil {
-		// Attempt to process streamed response.
-		prefix := []byte("data: ")
-
-		reader := bytes.NewReader(body)
-		scanner := bufio.NewScanner(reader)
-
-		buf := make([]byte, ReadBufferSize)
-		scanner.Buffer(buf, ReadBufferSize)
+// AllowHeaders removes every header of the RecordedRequest that is not listed,
+// except Test-Name, which names the recording file. It keeps every header
+// when none is listed. Header names are case-insensitive.
+func (r *RecordedRequest) AllowHeaders(headers []string) {
+	if len(headers) == 0 {
+		return
+	}
+	allowed := headerSet(headers)
+	for name := range r.Headers {
+		if name != "Test-Name" && !allowed[http.CanonicalHeaderKey(name)] {
+			delete(r.Headers, name)
+		}
+	}
+}
 
-		for scanner.Scan() {
-			lineBytes := scanner.Bytes()
-			if len(lineBytes) == 0 {
-				continue
-			}
+// NewRecordedResponse creates a RecordedResponse from a response of the
+// endpoint and its body. The headers are filtered by the endpoint's
+// allow_response_headers and redact_response_headers, and the secrets are
+// redacted from the header values and the body.
+func NewRecordedResponse(resp *http.Response, cfg config.EndpointConfig, redactor *redact.Redact, body []byte) (*RecordedResponse, error) {
+	encoding := strings.Join(resp.Header.Values("Content-Encoding"), ", ")
+	decoded := DecodedContentEncoding(encoding)
+	if decoded && len(body) > 0 {
+		var err error
+		if body, err = decodeBody(encoding, body); err != nil {
+			return nil, fmt.Errorf("failed to decode %s response body: %w", encoding, err)
+		}
+	}
 
-			if jsonBytes, ok := bytes.CutPrefix(lineBytes, prefix); ok {
-				var jsonMap map[string]any
-				if err := json.Unmarshal(jsonBytes, &jsonMap); err != nil {
-					log.Printf("Error unmarshaling JSON: %v", err)
-					continue
-				}
+	recordedResponse := &RecordedResponse{
+		StatusCode: int32(resp.StatusCode),
+		Headers:    NewHeader(resp.Header),
+	}
+	recordedResponse.Headers.Filter(cfg.AllowResponseHeaders, cfg.RedactResponseHeaders)
+	for _, values := range recordedResponse.Headers {
+		for i, value := range values {
+			values[i] = redactor.String(value)
+		}
+	}
 
-				bodySegments = append(bodySegments, redactor.Map(jsonMap))
-			}
+	if !decoded {
+		// The client needs the header to decode the body, whatever the
+		// allowed headers.
+		recordedResponse.Headers["Content-Encoding"] = resp.Header.Values("Content-Encoding")
+		if len(body) > 0 {
+			fmt.Printf("Storing the %s encoded response body without redacting it\n", encoding)
+			recordedResponse.Body = NewBody(resp.Header.Get("Content-Type"), body)
 		}
+		return recordedResponse, nil
+	}
 
-		if err := scanner.Err(); err != nil {
-			log.Fatalf("Error reading input bytes: %v", err)
+	if IsEventStream(resp.Header.Get("Content-Type")) {
+		events, err := ParseSSEEvents(body)
+		if err != nil {
 			return nil, err
 		}
-	} else {
-		bodySegments = append(bodySegments, redactor.Map(bodySegment))
+		for _, event := range events {
+			recordedResponse.Events = append(recordedResponse.Events, event.Redact(redactor))
+		}
+		return recordedResponse, nil
 	}
 
-	recordedResponse := &RecordedResponse{
-		StatusCode:   int32(resp.StatusCode),
-		Headers:      GetHeadersMap(&resp.Header),
-		BodySegments: bodySegments,
+	// The body is stored as sent by the server, so that replay returns it
+	// byte for byte with its numbers, key order and formatting.
+	if len(body) > 0 {
+		recordedResponse.Body = NewBody(resp.Header.Get("Content-Type"), body).Redact(redactor)
 	}
 	return recordedResponse, nil
 }
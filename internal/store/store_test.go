@@ -18,11 +18,19 @@ package store
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/google/test-server/internal/config"
+	"github.com/google/test-server/internal/redact"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
 )
 
@@ -37,7 +45,7 @@ func TestRecordedRequest_Serialize(t *testing.T) {
 			request: RecordedRequest{
 				Request:         "",
 				Headers:         map[string]string{},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -53,7 +61,7 @@ func TestRecordedRequest_Serialize(t *testing.T) {
 					"Accept":       "application/xml",
 					"Content-Type": "application/json",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -66,7 +74,7 @@ func TestRecordedRequest_Serialize(t *testing.T) {
 			request: RecordedRequest{
 				Request:         "POST /data HTTP/1.1",
 				Headers:         map[string]string{},
-				BodySegments:    []map[string]any{{"key": "value"}},
+				BodySegments:    []any{map[string]any{"key": "value"}},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -79,7 +87,7 @@ func TestRecordedRequest_Serialize(t *testing.T) {
 			request: RecordedRequest{
 				Request:         "GET / HTTP/1.1",
 				Headers:         map[string]string{},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
 				ServerAddress:   "",
 				Port:            0,
@@ -120,7 +128,7 @@ func TestNewRecordedRequest(t *testing.T) {
 			expected: &RecordedRequest{
 				Request:         "POST http://example.com/test HTTP/1.1",
 				Headers:         map[string]string{"Content-Type": "application/json"},
-				BodySegments:    []map[string]any{{"test body": ""}},
+				BodySegments:    []any{map[string]any{"test body": ""}},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "example.com",
 				Port:            443,
@@ -142,7 +150,53 @@ func TestNewRecordedRequest(t *testing.T) {
 			expected: &RecordedRequest{
 				Request:         "GET http://example.com/test HTTP/1.1",
 				Headers:         map[string]string{},
-				BodySegments:    []map[string]any{{}},
+				BodySegments:    []any{map[string]any{}},
+				PreviousRequest: HeadSHA,
+				ServerAddress:   "example.com",
+				Port:            443,
+				Protocol:        "https",
+			},
+			expectedErr: false,
+		},
+		{
+			name: "Test with form body",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "http://example.com/test", bytes.NewBuffer([]byte("a=1&b=2")))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			}(),
+			cfg: config.EndpointConfig{
+				TargetHost: "example.com",
+				TargetPort: 443,
+				TargetType: "https",
+			},
+			expected: &RecordedRequest{
+				Request:         "POST http://example.com/test HTTP/1.1",
+				Headers:         map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+				Body:            &Body{ContentType: "application/x-www-form-urlencoded", Encoding: BodyEncodingText, Data: "a=1&b=2"},
+				PreviousRequest: HeadSHA,
+				ServerAddress:   "example.com",
+				Port:            443,
+				Protocol:        "https",
+			},
+			expectedErr: false,
+		},
+		{
+			name: "Test with binary body",
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "http://example.com/test", bytes.NewBuffer([]byte{0x08, 0x96, 0x01, 0xff}))
+				req.Header.Set("Content-Type", "application/x-protobuf")
+				return req
+			}(),
+			cfg: config.EndpointConfig{
+				TargetHost: "example.com",
+				TargetPort: 443,
+				TargetType: "https",
+			},
+			expected: &RecordedRequest{
+				Request:         "POST http://example.com/test HTTP/1.1",
+				Headers:         map[string]string{"Content-Type": "application/x-protobuf"},
+				Body:            &Body{ContentType: "application/x-protobuf", Encoding: BodyEncodingBase64, Data: "CJYB/w=="},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "example.com",
 				Port:            443,
@@ -179,11 +233,43 @@ func TestNewRecordedRequest(t *testing.T) {
 			require.Equal(t, tc.expected.Request, recordedRequest.Request)
 			require.Equal(t, tc.expected.Headers, recordedRequest.Headers)
 			require.Equal(t, tc.expected.BodySegments, recordedRequest.BodySegments)
+			require.Equal(t, tc.expected.Body, recordedRequest.Body)
 			require.Equal(t, tc.expected.PreviousRequest, recordedRequest.PreviousRequest)
 		})
 	}
 }
 
+func TestNewRecordedRequest_LargeIntegers(t *testing.T) {
+	newRequest := func(body string) *RecordedRequest {
+		req, err := http.NewRequest("POST", "http://example.com/items", strings.NewReader(body))
+		require.NoError(t, err)
+		recordedRequest, err := NewRecordedRequest(req, HeadSHA, config.EndpointConfig{})
+		require.NoError(t, err)
+		return recordedRequest
+	}
+
+	// The IDs differ only above 2^53.
+	first := newRequest(`{"id": 9007199254740993, "price": 1.50, "count": 2}`)
+	second := newRequest(`{"id": 9007199254740992, "price": 1.50, "count": 2}`)
+	require.NotEqual(t, first.ComputeSum(), second.ComputeSum())
+	require.Equal(t, json.Number("9007199254740993"), first.BodySegments[0].(map[string]any)["id"])
+
+	// Other numbers are decoded as before, so existing recordings still match.
+	require.Equal(t, 2.0, first.BodySegments[0].(map[string]any)["count"])
+	legacy := *second
+	legacy.BodySegments = []any{map[string]any{"id": 9007199254740992.0, "price": 1.5, "count": 2.0}}
+	require.Equal(t, legacy.ComputeSum(), second.ComputeSum())
+
+	// The recording keeps every digit.
+	data, err := json.Marshal(first)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"id":9007199254740993`)
+	var loaded RecordedRequest
+	require.NoError(t, json.Unmarshal(data, &loaded))
+	require.Equal(t, first.BodySegments, loaded.BodySegments)
+	require.Equal(t, first.ComputeSum(), loaded.ComputeSum())
+}
+
 func TestRecordedRequest_RedactHeaders(t *testing.T) {
 	testCases := []struct {
 		name            string
@@ -199,7 +285,7 @@ func TestRecordedRequest_RedactHeaders(t *testing.T) {
 					"Accept":       "application/xml",
 					"Content-Type": "application/json",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -219,7 +305,7 @@ func TestRecordedRequest_RedactHeaders(t *testing.T) {
 					"Content-Type":  "application/json",
 					"Authorization": "Bearer token",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -237,7 +323,7 @@ func TestRecordedRequest_RedactHeaders(t *testing.T) {
 				Headers: map[string]string{
 					"Accept": "application/xml",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -256,7 +342,7 @@ func TestRecordedRequest_RedactHeaders(t *testing.T) {
 					"Accept":       "application/xml",
 					"Content-Type": "application/json",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -275,6 +361,109 @@ func TestRecordedRequest_RedactHeaders(t *testing.T) {
 	}
 }
 
+func TestRecordedRequest_AllowHeaders(t *testing.T) {
+	testCases := []struct {
+		name            string
+		headersToAllow  []string
+		expectedHeaders map[string]string
+	}{
+		{
+			name:           "Allow some headers",
+			headersToAllow: []string{"content-type"},
+			expectedHeaders: map[string]string{
+				"Content-Type": "application/json",
+				"Test-Name":    "test",
+			},
+		},
+		{
+			name:           "Allow every header",
+			headersToAllow: nil,
+			expectedHeaders: map[string]string{
+				"Accept":       "application/xml",
+				"Content-Type": "application/json",
+				"Test-Name":    "test",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := RecordedRequest{
+				Headers: map[string]string{
+					"Accept":       "application/xml",
+					"Content-Type": "application/json",
+					"Test-Name":    "test",
+				},
+			}
+			request.AllowHeaders(tc.headersToAllow)
+			require.Equal(t, tc.expectedHeaders, request.Headers)
+		})
+	}
+}
+
+func TestRecordedRequest_RedactQueryParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		url             string
+		params          []string
+		remove          []string
+		expectedURL     string
+		expectedRequest string
+	}{
+		{
+			name:            "Redact parameter",
+			url:             "/v1/models?key=AIzaSecret&alt=sse",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models?key=REDACTED&alt=sse",
+			expectedRequest: "GET /v1/models?key=REDACTED&alt=sse HTTP/1.1",
+		},
+		{
+			name:            "Remove parameters",
+			url:             "/v1/models?key=AIzaSecret&alt=sse&t=1",
+			remove:          []string{"key", "t"},
+			expectedURL:     "/v1/models?alt=sse",
+			expectedRequest: "GET /v1/models?alt=sse HTTP/1.1",
+		},
+		{
+			name:            "Remove every parameter",
+			url:             "/v1/models?key=AIzaSecret",
+			remove:          []string{"key"},
+			expectedURL:     "/v1/models",
+			expectedRequest: "GET /v1/models HTTP/1.1",
+		},
+		{
+			name:            "Escaped and repeated parameters",
+			url:             "/v1/models?b=%20x&key=a%2Fb&key=c",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models?b=%20x&key=REDACTED&key=REDACTED",
+			expectedRequest: "GET /v1/models?b=%20x&key=REDACTED&key=REDACTED HTTP/1.1",
+		},
+		{
+			name:            "Missing parameter keeps the URL",
+			url:             "/v1/models?b=%20x&a=1",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models?b=%20x&a=1",
+			expectedRequest: "GET /v1/models?b=%20x&a=1 HTTP/1.1",
+		},
+		{
+			name:            "No query",
+			url:             "/v1/models",
+			params:          []string{"key"},
+			expectedURL:     "/v1/models",
+			expectedRequest: "GET /v1/models HTTP/1.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := RecordedRequest{URL: tc.url, Request: "GET " + tc.url + " HTTP/1.1"}
+			request.RedactQueryParams(tc.params, tc.remove, nil)
+			require.Equal(t, tc.expectedURL, request.URL)
+			require.Equal(t, tc.expectedRequest, request.Request)
+		})
+	}
+}
+
 func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 	testCases := []struct {
 		name        string
@@ -289,7 +478,7 @@ func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 				Headers: map[string]string{
 					"Test-Name": "random test name",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -305,7 +494,7 @@ func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 				Headers: map[string]string{
 					"Test-Name": "",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -321,7 +510,7 @@ func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 				Headers: map[string]string{
 					"Test-Name": "../invalid_name",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -338,7 +527,7 @@ func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 					"Accept":       "application/xml",
 					"Content-Type": "application/json",
 				},
-				BodySegments:    []map[string]any{},
+				BodySegments:    []any{},
 				PreviousRequest: HeadSHA,
 				ServerAddress:   "",
 				Port:            0,
@@ -361,6 +550,206 @@ func TestRecordedRequest_GetRecordFileName(t *testing.T) {
 	}
 }
 
+func TestNewRecordedResponse(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	}
+	deflated := func(data []byte) []byte {
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	}
+	rawDeflated := func(data []byte) []byte {
+		var buf bytes.Buffer
+		writer, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		writer.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	}
+	brotlied := func(data []byte) []byte {
+		var buf bytes.Buffer
+		writer := brotli.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	}
+	zstded := func(data []byte) []byte {
+		encoder, _ := zstd.NewWriter(nil)
+		defer encoder.Close()
+		return encoder.EncodeAll(data, nil)
+	}
+	secretJSON := []byte(`{"key": "secret"}`)
+	redactedJSON := &Body{ContentType: "application/json", Encoding: BodyEncodingText, Data: `{"key": "REDACTED"}`}
+
+	testCases := []struct {
+		name           string
+		header         http.Header
+		body           []byte
+		expectedBody   *Body
+		expectedEvents []*SSEEvent
+	}{
+		{
+			name:         "JSON body",
+			header:       http.Header{"Content-Type": {"application/json"}},
+			body:         []byte("{\n  \"z\": 9007199254740993,\n  \"key\": \"secret\"\n}\n"),
+			expectedBody: &Body{ContentType: "application/json", Encoding: BodyEncodingText, Data: "{\n  \"z\": 9007199254740993,\n  \"key\": \"REDACTED\"\n}\n"},
+		},
+		{
+			name:         "Streamed JSON body without event stream content type",
+			header:       http.Header{},
+			body:         []byte("data: {\"a\": 1}\n\ndata: {\"b\": 2}\n\n"),
+			expectedBody: &Body{Encoding: BodyEncodingText, Data: "data: {\"a\": 1}\n\ndata: {\"b\": 2}\n\n"},
+		},
+		{
+			name:   "Event stream",
+			header: http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}},
+			body:   []byte(": ping\n\nevent: message\nid: 1\ndata: {\"key\": \"secret\"}\n\n"),
+			expectedEvents: []*SSEEvent{
+				{Comments: []string{"ping"}},
+				{Event: "message", ID: "1", Data: []string{`{"key": "REDACTED"}`}},
+			},
+		},
+		{
+			name:         "HTML body",
+			header:       http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			body:         []byte("<html>secret</html>"),
+			expectedBody: &Body{ContentType: "text/html; charset=utf-8", Encoding: BodyEncodingText, Data: "<html>REDACTED</html>"},
+		},
+		{
+			name:         "Gzipped binary body",
+			header:       http.Header{"Content-Type": {"image/png"}, "Content-Encoding": {"gzip"}},
+			body:         gzipped([]byte{0x89, 0x50, 0x4e, 0x47}),
+			expectedBody: &Body{ContentType: "image/png", Encoding: BodyEncodingBase64, Data: "iVBORw=="},
+		},
+		{
+			name:         "Deflate body",
+			header:       http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"deflate"}},
+			body:         deflated(secretJSON),
+			expectedBody: redactedJSON,
+		},
+		{
+			name:         "Raw deflate body",
+			header:       http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"deflate"}},
+			body:         rawDeflated(secretJSON),
+			expectedBody: redactedJSON,
+		},
+		{
+			name:         "Brotli body",
+			header:       http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"br"}},
+			body:         brotlied(secretJSON),
+			expectedBody: redactedJSON,
+		},
+		{
+			name:         "Zstandard body",
+			header:       http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"zstd"}},
+			body:         zstded(secretJSON),
+			expectedBody: redactedJSON,
+		},
+		{
+			name:   "Brotli event stream",
+			header: http.Header{"Content-Type": {"text/event-stream"}, "Content-Encoding": {"br"}},
+			body:   brotlied([]byte("data: {\"key\": \"secret\"}\n\n")),
+			expectedEvents: []*SSEEvent{
+				{Data: []string{`{"key": "REDACTED"}`}},
+			},
+		},
+		{
+			name:         "Unsupported encoding",
+			header:       http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"compress"}},
+			body:         []byte{0x1f, 0x9d, 0x90},
+			expectedBody: &Body{ContentType: "application/json", Encoding: BodyEncodingBase64, Data: "H52Q"},
+		},
+		{
+			name:   "Empty body",
+			header: http.Header{},
+			body:   []byte{},
+		},
+		{
+			name:   "Empty gzip body",
+			header: http.Header{"Content-Encoding": {"gzip"}},
+			body:   []byte{},
+		},
+	}
+
+	redactor, err := redact.NewRedact([]string{"secret"})
+	require.NoError(t, err)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: tc.header}
+			recordedResponse, err := NewRecordedResponse(resp, config.EndpointConfig{}, redactor, tc.body)
+			require.NoError(t, err)
+			require.Equal(t, int32(http.StatusOK), recordedResponse.StatusCode)
+			require.Nil(t, recordedResponse.BodySegments)
+			require.Equal(t, tc.expectedBody, recordedResponse.Body)
+			require.Equal(t, tc.expectedEvents, recordedResponse.Events)
+		})
+	}
+}
+
+func TestNewRecordedResponse_Headers(t *testing.T) {
+	header := http.Header{
+		"Content-Type":            {"application/json"},
+		"Set-Cookie":              {"session=secret; Path=/", "theme=dark"},
+		"X-Request-Id":            {"1234"},
+		"Content-Security-Policy": {"default-src 'self'"},
+	}
+	testCases := []struct {
+		name            string
+		cfg             config.EndpointConfig
+		expectedHeaders Header
+	}{
+		{
+			name: "Keep every header",
+			cfg:  config.EndpointConfig{},
+			expectedHeaders: Header{
+				"Content-Type":            {"application/json"},
+				"Set-Cookie":              {"session=REDACTED; Path=/", "theme=dark"},
+				"X-Request-Id":            {"1234"},
+				"Content-Security-Policy": {"default-src 'self'"},
+			},
+		},
+		{
+			name: "Redact headers",
+			cfg:  config.EndpointConfig{RedactResponseHeaders: []string{"set-cookie", "Content-Security-Policy"}},
+			expectedHeaders: Header{
+				"Content-Type": {"application/json"},
+				"X-Request-Id": {"1234"},
+			},
+		},
+		{
+			name: "Allow headers",
+			cfg: config.EndpointConfig{
+				AllowResponseHeaders:  []string{"Content-Type", "x-request-id"},
+				RedactResponseHeaders: []string{"X-Request-Id"},
+			},
+			expectedHeaders: Header{
+				"Content-Type": {"application/json"},
+			},
+		},
+	}
+
+	redactor, err := redact.NewRedact([]string{"secret"})
+	require.NoError(t, err)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: header}
+			recordedResponse, err := NewRecordedResponse(resp, tc.cfg, redactor, []byte("{}"))
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedHeaders, recordedResponse.Headers)
+		})
+	}
+	// The response headers are not modified.
+	require.Equal(t, "session=secret; Path=/", header.Get("Set-Cookie"))
+}
+
 type errorReader struct{}
 
 func (e *errorReader) Read(p []byte) (n int, err error) {
@@ -0,0 +1,150 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timing holds when the parts of a response were received from the target
+// server, relative to when the request was sent.
+type Timing struct {
+	// FirstByteMs is when the response headers were received.
+	FirstByteMs int64 `json:"firstByteMs"`
+	// SegmentOffsetsMs holds when each event of an event stream or each
+	// element of a JSON array response was received. For other responses it
+	// holds when the whole body was received.
+	SegmentOffsetsMs []int64 `json:"segmentOffsetsMs,omitempty"`
+}
+
+// ChunkTiming records when a chunk of a response body was received.
+type ChunkTiming struct {
+	// End is the offset in the body right after the chunk.
+	End     int
+	Elapsed time.Duration
+}
+
+// NewTiming computes the timing of a response from the arrival times of the
+// chunks of its body, as received on the wire.
+func NewTiming(header http.Header, body []byte, firstByte time.Duration, chunks []ChunkTiming) *Timing {
+	timing := &Timing{FirstByteMs: firstByte.Milliseconds()}
+	if len(chunks) == 0 {
+		return timing
+	}
+
+	decoded, offsets, err := decodeWithOffsets(header, body)
+	if err == nil {
+		var ends []int
+		if IsEventStream(header.Get("Content-Type")) {
+			_, ends, err = parseSSEEvents(decoded)
+		} else {
+			ends = JSONArrayElementEnds(decoded)
+		}
+		if err == nil && len(ends) > 0 {
+			for _, end := range ends {
+				elapsed := arrival(chunks, offsets.wire(end))
+				timing.SegmentOffsetsMs = append(timing.SegmentOffsetsMs, elapsed.Milliseconds())
+			}
+			return timing
+		}
+	}
+
+	timing.SegmentOffsetsMs = []int64{chunks[len(chunks)-1].Elapsed.Milliseconds()}
+	return timing
+}
+
+// arrival returns when the byte before the wire offset was received.
+func arrival(chunks []ChunkTiming, offset int) time.Duration {
+	for _, chunk := range chunks {
+		if chunk.End >= offset {
+			return chunk.Elapsed
+		}
+	}
+	return chunks[len(chunks)-1].Elapsed
+}
+
+// offsetMap maps offsets in a decoded body to offsets in the body received
+// on the wire. A nil map is the identity.
+type offsetMap []struct{ decoded, wire int }
+
+func (m offsetMap) wire(decoded int) int {
+	if m == nil {
+		return decoded
+	}
+	for _, offset := range m {
+		if offset.decoded >= decoded {
+			return offset.wire
+		}
+	}
+	return m[len(m)-1].wire
+}
+
+// countingReader counts the bytes consumed by a decompressor. It implements
+// io.ByteReader so the decompressor does not read ahead.
+type countingReader struct {
+	r *bytes.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// decodeWithOffsets removes the content encoding of a body, keeping track of
+// which part of the encoded body every part of the decoded body came from.
+func decodeWithOffsets(header http.Header, body []byte) ([]byte, offsetMap, error) {
+	encoding := strings.Join(header.Values("Content-Encoding"), ", ")
+	if encoding == "" || !DecodedContentEncoding(encoding) {
+		return body, nil, nil
+	}
+
+	counter := &countingReader{r: bytes.NewReader(body)}
+	decoder, err := newDecoder(encoding, counter)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer decoder.Close()
+
+	var decoded bytes.Buffer
+	var offsets offsetMap
+	buf := make([]byte, 256)
+	for {
+		n, err := decoder.Read(buf)
+		decoded.Write(buf[:n])
+		offsets = append(offsets, struct{ decoded, wire int }{decoded.Len(), counter.n})
+		if err == io.EOF {
+			return decoded.Bytes(), offsets, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
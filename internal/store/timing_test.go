@@ -0,0 +1,90 @@
+/*
+Copyright 2025 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTiming(t *testing.T) {
+	events := []string{"data: 1\n\n", "data: 2\n\n", "data: 3\n\n"}
+
+	t.Run("Event stream", func(t *testing.T) {
+		header := http.Header{"Content-Type": {"text/event-stream"}}
+		body := []byte(events[0] + events[1] + events[2])
+		// The first two events arrive together, the last one separately.
+		chunks := []ChunkTiming{
+			{End: 18, Elapsed: 100 * time.Millisecond},
+			{End: 27, Elapsed: 250 * time.Millisecond},
+		}
+
+		timing := NewTiming(header, body, 50*time.Millisecond, chunks)
+		require.Equal(t, &Timing{FirstByteMs: 50, SegmentOffsetsMs: []int64{100, 100, 250}}, timing)
+	})
+
+	t.Run("Gzipped event stream", func(t *testing.T) {
+		header := http.Header{"Content-Type": {"text/event-stream"}, "Content-Encoding": {"gzip"}}
+		var body bytes.Buffer
+		var chunks []ChunkTiming
+		writer := gzip.NewWriter(&body)
+		for i, event := range events {
+			writer.Write([]byte(event))
+			writer.Flush()
+			chunks = append(chunks, ChunkTiming{End: body.Len(), Elapsed: time.Duration(i+1) * 100 * time.Millisecond})
+		}
+		writer.Close()
+		chunks[len(chunks)-1].End = body.Len()
+
+		timing := NewTiming(header, body.Bytes(), 50*time.Millisecond, chunks)
+		require.Equal(t, &Timing{FirstByteMs: 50, SegmentOffsetsMs: []int64{100, 200, 300}}, timing)
+	})
+
+	t.Run("JSON array stream", func(t *testing.T) {
+		header := http.Header{"Content-Type": {"application/json"}}
+		body := []byte(`[{"a":1},{"b":2},{"c":3}]`)
+		// The first element arrives on its own, the other two together.
+		chunks := []ChunkTiming{
+			{End: 9, Elapsed: 100 * time.Millisecond},
+			{End: len(body), Elapsed: 250 * time.Millisecond},
+		}
+
+		timing := NewTiming(header, body, 50*time.Millisecond, chunks)
+		require.Equal(t, &Timing{FirstByteMs: 50, SegmentOffsetsMs: []int64{100, 250, 250}}, timing)
+	})
+
+	t.Run("Single body", func(t *testing.T) {
+		header := http.Header{"Content-Type": {"application/json"}}
+		chunks := []ChunkTiming{
+			{End: 10, Elapsed: 100 * time.Millisecond},
+			{End: 20, Elapsed: 300 * time.Millisecond},
+		}
+
+		timing := NewTiming(header, make([]byte, 20), 50*time.Millisecond, chunks)
+		require.Equal(t, &Timing{FirstByteMs: 50, SegmentOffsetsMs: []int64{300}}, timing)
+	})
+
+	t.Run("Empty body", func(t *testing.T) {
+		timing := NewTiming(http.Header{}, nil, 50*time.Millisecond, nil)
+		require.Equal(t, &Timing{FirstByteMs: 50}, timing)
+	})
+}
@@ -114,10 +114,41 @@ namespace TestServerSdk
     {
       if (_process == null || _process.HasExited)
         return;
+      // Kill cannot be handled by test-server, so ask it to write the
+      // recordings first.
+      if (_options.Mode == "record")
+        await FlushRecordings();
       _process.Kill();
       await Task.Run(() => _process.WaitForExit(5000));
     }
 
+    private async Task FlushRecordings()
+    {
+      var yaml = File.ReadAllText(_options.ConfigPath);
+      var yamlStream = new YamlStream();
+      yamlStream.Load(new StringReader(yaml));
+      var root = (YamlMappingNode)yamlStream.Documents[0].RootNode;
+      if (!root.Children.ContainsKey(new YamlScalarNode("endpoints"))) return;
+      var endpoints = (YamlSequenceNode)root.Children[new YamlScalarNode("endpoints")];
+      if (endpoints.Children.Count == 0) return;
+      // Any endpoint writes the recordings of all of them.
+      var endpoint = (YamlMappingNode)endpoints.Children[0];
+      var sourceType = endpoint.Children[new YamlScalarNode("source_type")].ToString();
+      var sourcePort = endpoint.Children[new YamlScalarNode("source_port")].ToString();
+      var url = $"{sourceType}://localhost:{sourcePort}/test-server/flush";
+      try
+      {
+        using var client = new HttpClient();
+        var response = await client.PostAsync(url, null);
+        if (!response.IsSuccessStatusCode)
+          _options.OnStdErr?.Invoke($"Failed to write recordings: {await response.Content.ReadAsStringAsync()}");
+      }
+      catch (Exception ex)
+      {
+        _options.OnError?.Invoke(ex);
+      }
+    }
+
     private async Task AwaitHealthyTestServer()
     {
       var yaml = File.ReadAllText(_options.ConfigPath);